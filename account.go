@@ -20,13 +20,12 @@ func AccountStart(sess *Session, cfg AccountConfig, Attr ...string) []byte {
 	p := AccountRequest{}
 	p.Header.Version = (MajorVersion | MinorVersionDefault)
 	p.Header.Type = TypeAcct
-	p.Header.SeqNo = sess.SessionSeqNo
-	sess.SessionSeqNo++
-	sess.mng.RLock()
-	if sess.mng.Config.ConnMultiplexing {
+	sess.Lock()
+	p.Header.SeqNo = sess.nextSeqNo(p.Header.Version, p.Header.Type)
+	sess.Unlock()
+	if sess.pool.config.ConnMultiplexing {
 		p.Header.Flags |= SingleConnectFlag
 	}
-	sess.mng.RUnlock()
 
 	p.Header.SessionID = sess.SessionID
 	p.Header.Length = 9
@@ -63,7 +62,7 @@ func AccountStart(sess *Session, cfg AccountConfig, Attr ...string) []byte {
 	if p.ArgCnt != 0 {
 		p.Header.Length += uint32(len(Attr))
 		for _, arg := range Attr {
-			fmt.Printf("arg:%s,len:%d\n", arg, len(arg))
+			fmt.Printf("arg:%s,len:%d\n", redactArg(arg), len(arg))
 			p.Header.Length += uint32(len(arg))
 		}
 	}
@@ -84,20 +83,28 @@ func AccountStart(sess *Session, cfg AccountConfig, Attr ...string) []byte {
 		buf = append(buf, arg...)
 	}
 	fmt.Printf("len(AccountRequest):%d\n", len(buf))
-	crypt(buf, []byte(sess.mng.Config.ShareKey))
+	sess.obfuscate(buf)
 	return buf
 }
 
 func AccountResponse(sess *Session, data []byte) error {
 	p := &AccountReply{}
+	//the header is in the clear, check it before the body is decoded
+	if err := (&p.Header).unmarshal(data); err != nil {
+		return err
+	}
+	if err := p.SanityCheck(sess, data); err != nil {
+		return err
+	}
 
-	crypt(data, []byte(sess.mng.Config.ShareKey))
-	p.unmarshal(data)
-
-	err := p.SanityCheck(sess, data)
-	if err != nil {
+	if err := sess.deobfuscate(data); err != nil {
+		return err
+	}
+	if err := p.unmarshal(data); err != nil {
+		fmt.Printf("decode reply fail,%s\n", err.Error())
 		return err
 	}
+	sess.setResult(&Result{Status: p.Status, ServerMsg: p.ServerMsg, Data: p.Data})
 
 	switch p.Status {
 	case AccountStatusSuccess:
@@ -117,34 +124,52 @@ func AccountResponse(sess *Session, data []byte) error {
 	}
 }
 
-func Account(sess *Session, cfg AccountConfig, Attr ...string) error {
+// Account returns the final reply of the server along with the error, the
+// result is nil when no reply could be decoded
+func Account(sess *Session, cfg AccountConfig, Attr ...string) (*Result, error) {
+	err := account(sess, cfg, Attr...)
+	return sess.lastResult(), err
+}
+
+func account(sess *Session, cfg AccountConfig, Attr ...string) (err error) {
+	defer sess.observe(TypeAcct, time.Now(), &err, Attr...)
+	if err := sess.begin(); err != nil {
+		return err
+	}
 
 	//prepare the request packet
 	data := AccountStart(sess, cfg, Attr...)
-	sess.t.Lock()
-	if !sess.t.Done {
-		fmt.Printf("write len:%d\n", len(data))
-		sess.t.sendChn <- data
-	} else {
-		fmt.Println("transport buffer closed, ASCIIAuthen fail")
-		sess.t.Unlock()
-		sess.close()
-		return errors.New("transport buffer closed, ASCIIAuthen fail")
+	if err := sess.send(data); err != nil {
+		fmt.Printf("%s, Account fail\n", err.Error())
+		return err
 	}
-	sess.t.Unlock()
 
 	//waitting for server reply
 	for {
+		reply := sess.pending()
 		select {
-		case buffer := <-sess.ReadBuffer:
+		case <-reply.done:
+			buffer, err := sess.collect(reply)
+			if err != nil {
+				fmt.Printf("transport fail, %s\n", err.Error())
+				return err
+			}
 			fmt.Println("receive account reply,len:", len(buffer))
-			return AccountResponse(sess, buffer)
+			err = AccountResponse(sess, buffer)
+			if errors.Is(err, ErrBadSecret) && sess.rekey() {
+				//start over with the next shared key
+				data = AccountStart(sess, cfg, Attr...)
+				if err = sess.send(data); err == nil {
+					continue
+				}
+			}
+			return err
 
 		case <-time.After(time.Duration(sess.timeout) * time.Second):
 			fmt.Printf("receive reply timeout\n")
 			//关闭连接
 			//sess.close()
-			return errors.New("timeout")
+			return ErrTimeout
 
 		case <-sess.ctx.Done():
 			fmt.Printf("sess close")
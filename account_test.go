@@ -36,7 +36,7 @@ func TestAccount(t *testing.T) {
 	startTime := make([]string, 2)
 	startTime[0] = "start_time="
 	time := strings.Join(startTime, strconv.FormatInt(secs, 10))
-	err = Account(sess, account, "task_id=100", time)
+	_, err = Account(sess, account, "task_id=100", time)
 
 	if err != nil {
 		fmt.Println("Account fail, error msg :" + err.Error())
@@ -0,0 +1,98 @@
+// async.go
+package tacacs
+
+import (
+	"context"
+	"errors"
+)
+
+// Future is the outcome of a request started by one of the Async calls
+type Future struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// Done is closed once the request has finished
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err waits for the request to finish and returns its error
+func (f *Future) Err() error {
+	<-f.done
+	return f.err
+}
+
+// Result waits for the request to finish and returns the final reply of the
+// server, nil when none could be decoded
+func (f *Future) Result() *Result {
+	<-f.done
+	return f.result
+}
+
+// Wait is Err bounded by ctx, the request itself keeps running
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startAsync acquires a session and runs fn on it in the background. It
+// blocks while the pool has no free slot: at most MaxConns connections with
+// MaxInFlight sessions each are in flight, so a caller firing requests faster
+// than the server answers them is held back here until ctx is done. Requests
+// of different sessions are pipelined on a shared connection.
+func startAsync(ctx context.Context, timeout int, user, passwd string, fn func(sess *Session) error) (*Future, error) {
+	if TacacsMng == nil {
+		return nil, errors.New("tacacs not init")
+	}
+	sess, err := NewSession(ctx, timeout, user, passwd)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Future{done: make(chan struct{})}
+	go func() {
+		f.err = fn(sess)
+		f.result = sess.lastResult()
+		sess.Close()
+		close(f.done)
+	}()
+	return f, nil
+}
+
+// AuthenASCIIAsync is AuthenASCII returning as soon as the session holds a
+// connection, ctx bounds the wait for it and cancels the exchange
+func AuthenASCIIAsync(ctx context.Context, timeout int, username, password string) (*Future, error) {
+	return startAsync(ctx, timeout, username, password, func(sess *Session) error {
+		return authenticate(sess, AuthenTypeASCII)
+	})
+}
+
+// AuthenPAPAsync is AuthenPAP returning as soon as the session holds a
+// connection, ctx bounds the wait for it and cancels the exchange
+func AuthenPAPAsync(ctx context.Context, timeout int, username, password string) (*Future, error) {
+	return startAsync(ctx, timeout, username, password, func(sess *Session) error {
+		return authenticate(sess, AuthenTypePAP)
+	})
+}
+
+// AuthorAsync authorizes username in a session of its own, see Author
+func AuthorAsync(ctx context.Context, timeout int, username string, authorMethod, privLvl, authorType, authorSvc uint8, AttrValuePair ...string) (*Future, error) {
+	return startAsync(ctx, timeout, username, "", func(sess *Session) error {
+		_, err := author(sess, authorMethod, privLvl, authorType, authorSvc, AttrValuePair...)
+		return err
+	})
+}
+
+// AccountAsync sends an accounting record for username in a session of its
+// own, see Account
+func AccountAsync(ctx context.Context, timeout int, username string, cfg AccountConfig, Attr ...string) (*Future, error) {
+	return startAsync(ctx, timeout, username, "", func(sess *Session) error {
+		return account(sess, cfg, Attr...)
+	})
+}
@@ -0,0 +1,107 @@
+// async_test
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccountAsyncPipelined(t *testing.T) {
+	var mu sync.Mutex
+	var outstanding, most int
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		mu.Lock()
+		outstanding++
+		if outstanding > most {
+			most = outstanding
+		}
+		mu.Unlock()
+
+		//answer out of band so more requests arrive meanwhile
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			outstanding--
+			mu.Unlock()
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}()
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.PoolMaxConns = 2
+	config.MaxInFlight = 4
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+
+	var records []*Future
+	for i := 0; i < 100; i++ {
+		f, err := AccountAsync(context.Background(), 5, "alice", AccountConfig{Flags: AcctFlagStop}, "task_id=1")
+		if err != nil {
+			t.Fatalf("account record %d not started:%s", i, err.Error())
+		}
+		records = append(records, f)
+	}
+	for i, f := range records {
+		if err := f.Err(); err != nil {
+			t.Errorf("account record %d fail:%s", i, err.Error())
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most < 2 {
+		t.Errorf("requests not pipelined, at most %d outstanding", most)
+	}
+	if most > 8 {
+		t.Errorf("%d requests outstanding, limit is 2 connections of 4", most)
+	}
+}
+
+func TestAsyncBackpressure(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.PoolMaxConns = 1
+	config.MaxInFlight = 2
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+
+	var records []*Future
+	for i := 0; i < 2; i++ {
+		f, err := AuthorAsync(context.Background(), 30, "alice", AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+		if err != nil {
+			t.Fatalf("author %d not started:%s", i, err.Error())
+		}
+		records = append(records, f)
+	}
+
+	//the pool is full, the next caller is held back until its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := AuthorAsync(ctx, 30, "alice", AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("author past the in-flight limit:%v", err)
+	}
+	if n := TacacsPoolStats()[0].WaitTimeouts; n != 1 {
+		t.Errorf("wait timeouts:%d, expect 1", n)
+	}
+
+	//requests in flight fail with their transport
+	TacacsConfigSet(s.config())
+	for i, f := range records {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := f.Wait(ctx)
+		cancel()
+		var terr *TransportError
+		if !errors.As(err, &terr) {
+			t.Errorf("author %d:%v, expect a transport error", i, err)
+		}
+	}
+}
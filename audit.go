@@ -0,0 +1,239 @@
+// audit.go
+package tacacs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditKind tells what an audit event records
+type AuditKind uint8
+
+const (
+	AuditAuthen AuditKind = iota //an authentication success or failure
+	AuditAuthor                  //an authorization decision
+	AuditAcct                    //an accounting result
+)
+
+func (k AuditKind) String() string {
+	switch k {
+	case AuditAuthen:
+		return "authen"
+	case AuditAuthor:
+		return "author"
+	case AuditAcct:
+		return "acct"
+	default:
+		return "unknown(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// AuditEvent is the outcome of one exchange. It never holds the password,
+// and argument values that look secret are redacted.
+type AuditEvent struct {
+	Time      time.Time
+	Kind      AuditKind
+	User      string
+	RemAddr   string //local address the request was made from
+	Port      string
+	Server    string
+	SessionID uint32
+	Success   bool
+	Status    uint8    //status of the final reply, 0 when there was none
+	Reason    string   //server message, or the error when it didn't answer
+	Args      []string //attribute-value pairs of the request
+}
+
+// AuditSubscriber receives the audit events of a Manager. Audit is called on
+// the goroutine that ran the exchange and must not block.
+type AuditSubscriber interface {
+	Audit(ev AuditEvent)
+}
+
+// AuditFunc adapts a function to an AuditSubscriber
+type AuditFunc func(ev AuditEvent)
+
+func (f AuditFunc) Audit(ev AuditEvent) {
+	f(ev)
+}
+
+type auditHub struct {
+	sync.Mutex
+	subs map[int]AuditSubscriber
+	next int
+}
+
+// Subscribe registers s for every audit event of the manager's sessions, the
+// returned function unsubscribes it
+func (m *Manager) Subscribe(s AuditSubscriber) (unsubscribe func()) {
+	m.audit.Lock()
+	defer m.audit.Unlock()
+	if m.audit.subs == nil {
+		m.audit.subs = make(map[int]AuditSubscriber)
+	}
+	id := m.audit.next
+	m.audit.next++
+	m.audit.subs[id] = s
+	return func() {
+		m.audit.Lock()
+		delete(m.audit.subs, id)
+		m.audit.Unlock()
+	}
+}
+
+func (m *Manager) emit(ev AuditEvent) {
+	m.audit.Lock()
+	subs := make([]AuditSubscriber, 0, len(m.audit.subs))
+	for _, s := range m.audit.subs {
+		subs = append(subs, s)
+	}
+	m.audit.Unlock()
+	for _, s := range subs {
+		s.Audit(ev)
+	}
+}
+
+// audit emits the event of a finished exchange
+func (sess *Session) audit(typ uint8, err error, args []string) {
+	var kind AuditKind
+	switch typ {
+	case TypeAuthen:
+		kind = AuditAuthen
+	case TypeAuthor:
+		kind = AuditAuthor
+	default:
+		kind = AuditAcct
+	}
+	ev := AuditEvent{
+		Time:    time.Now(),
+		Kind:    kind,
+		User:    sess.UserName,
+		Success: err == nil,
+		Args:    redactArgs(args),
+	}
+	if sess.pool != nil {
+		ev.Server = sess.pool.server
+	}
+	sess.Lock()
+	ev.SessionID = sess.SessionID
+	local := sess.local
+	sess.Unlock()
+	if host, port, err := net.SplitHostPort(local); err == nil {
+		ev.RemAddr, ev.Port = host, port
+	}
+	if r := sess.lastResult(); r != nil {
+		ev.Status = r.Status
+		ev.Reason = r.ServerMsg
+	}
+	if err != nil && ev.Reason == "" {
+		ev.Reason = err.Error()
+	}
+	sess.mng.emit(ev)
+}
+
+// syslog facilities commonly used for security logs
+const (
+	SyslogAuth     = 4
+	SyslogAuthPriv = 10
+)
+
+// SyslogSink is an AuditSubscriber writing RFC 5424 messages to a local
+// syslog daemon over a Unix datagram or UDP socket
+type SyslogSink struct {
+	mu       sync.Mutex
+	nc       net.Conn
+	facility int
+	hostname string
+	appName  string
+	procID   string
+}
+
+// NewSyslogSink connects to addr, network is "unixgram" or "udp", e.g.
+// "unixgram" and "/dev/log". Stream sockets aren't supported, messages are
+// written without RFC 6587 framing.
+func NewSyslogSink(network, addr string, facility int) (*SyslogSink, error) {
+	switch network {
+	case "unixgram", "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", network)
+	}
+	if facility < 0 || facility > 23 {
+		return nil, fmt.Errorf("syslog facility %d out of range", facility)
+	}
+	nc, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{
+		nc:       nc,
+		facility: facility,
+		hostname: hostname,
+		appName:  "tacacs",
+		procID:   strconv.Itoa(os.Getpid()),
+	}, nil
+}
+
+// Audit writes ev, failures are logged and the event dropped
+func (s *SyslogSink) Audit(ev AuditEvent) {
+	msg := s.format(ev)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nc.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := s.nc.Write(msg); err != nil {
+		fmt.Printf("syslog write fail:%s\n", err.Error())
+	}
+}
+
+// Close closes the socket to the syslog daemon
+func (s *SyslogSink) Close() error {
+	return s.nc.Close()
+}
+
+// format builds the RFC 5424 message of ev, the structured data ID uses the
+// documentation enterprise number of RFC 5612
+func (s *SyslogSink) format(ev AuditEvent) []byte {
+	severity := 6 //informational
+	outcome := "success"
+	if !ev.Success {
+		severity = 4 //warning
+		outcome = "failure"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ", s.facility*8+severity,
+		ev.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.appName, s.procID, ev.Kind)
+	b.WriteString("[tacacs@32473")
+	sdParam(&b, "user", ev.User)
+	sdParam(&b, "rem_addr", ev.RemAddr)
+	sdParam(&b, "port", ev.Port)
+	sdParam(&b, "server", ev.Server)
+	sdParam(&b, "session_id", strconv.FormatUint(uint64(ev.SessionID), 10))
+	sdParam(&b, "outcome", outcome)
+	sdParam(&b, "status", strconv.Itoa(int(ev.Status)))
+	sdParam(&b, "reason", ev.Reason)
+	for _, arg := range ev.Args {
+		sdParam(&b, "arg", arg)
+	}
+	b.WriteString("] ")
+	fmt.Fprintf(&b, "%s %s for %s from %s via %s", ev.Kind, outcome, ev.User, ev.RemAddr, ev.Server)
+	if ev.Reason != "" {
+		b.WriteString(": " + ev.Reason)
+	}
+	return []byte(b.String())
+}
+
+// sdParam appends a structured data parameter, escaping the value as RFC
+// 5424 requires
+func sdParam(b *strings.Builder, name, value string) {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+	fmt.Fprintf(b, ` %s="%s"`, name, value)
+}
@@ -0,0 +1,142 @@
+// audit_test
+package tacacs
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAudit(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusFail, "denied"))
+		case TypeAcct:
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}
+	})
+	fakeInit(t, s)
+
+	var mu sync.Mutex
+	var events []AuditEvent
+	unsubscribe := TacacsMng.Subscribe(AuditFunc(func(ev AuditEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+
+	if _, err := AuthenPAP(5, "alice", "hunter2"); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "hunter2")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	if _, err := Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell", "cmd=enable"); err == nil {
+		t.Fatal("author passed")
+	}
+	if _, err := Account(sess, AccountConfig{Flags: AcctFlagStart}, "task_id=1", "new-password=hunter2", "chap-response*abc"); err != nil {
+		t.Fatalf("account fail:%s", err.Error())
+	}
+
+	unsubscribe()
+	AuthenPAP(5, "alice", "hunter2")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("%d events", len(events))
+	}
+	server := s.config().ServerIP
+	for i, kind := range []AuditKind{AuditAuthen, AuditAuthor, AuditAcct} {
+		ev := events[i]
+		if ev.Kind != kind || ev.User != "alice" || ev.RemAddr != server || ev.Port == "" || !strings.HasPrefix(ev.Server, server) || ev.SessionID == 0 {
+			t.Errorf("event %d %+v", i, ev)
+		}
+		if strings.Contains(fmt.Sprintf("%+v", ev), "hunter2") {
+			t.Errorf("event %d leaks the password:%+v", i, ev)
+		}
+	}
+	if !events[0].Success || events[0].Status != AuthenStatusPass {
+		t.Errorf("authen event %+v", events[0])
+	}
+	if events[1].Success || events[1].Status != AuthorStatusFail || events[1].Reason != "denied" {
+		t.Errorf("author event %+v", events[1])
+	}
+	if strings.Join(events[1].Args, ",") != "service=shell,cmd=enable" {
+		t.Errorf("author args %q", events[1].Args)
+	}
+	if strings.Join(events[2].Args, ",") != "task_id=1,new-password=<redacted>,chap-response*<redacted>" {
+		t.Errorf("acct args %q", events[2].Args)
+	}
+}
+
+var syslogLine = regexp.MustCompile(`^<84>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z \S+ tacacs \d+ author \[tacacs@32473 user="alice" rem_addr="10\.0\.0\.1" port="5000" server="10\.0\.0\.9:49" session_id="7" outcome="failure" status="16" reason="no \\] here" arg="cmd=enable"\] author failure for alice from 10\.0\.0\.1 via 10\.0\.0\.9:49: no \] here$`)
+
+func TestSyslogSink(t *testing.T) {
+	ev := AuditEvent{
+		Time:      time.Now(),
+		Kind:      AuditAuthor,
+		User:      "alice",
+		RemAddr:   "10.0.0.1",
+		Port:      "5000",
+		Server:    "10.0.0.9:49",
+		SessionID: 7,
+		Status:    AuthorStatusFail,
+		Reason:    "no ] here",
+		Args:      []string{"cmd=enable"},
+	}
+
+	path := filepath.Join(t.TempDir(), "log")
+	unixLn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen:%s", err.Error())
+	}
+	defer unixLn.Close()
+	udpLn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen:%s", err.Error())
+	}
+	defer udpLn.Close()
+
+	for _, c := range []struct {
+		network, addr string
+		ln            net.PacketConn
+	}{
+		{"unixgram", path, unixLn},
+		{"udp", udpLn.LocalAddr().String(), udpLn},
+	} {
+		sink, err := NewSyslogSink(c.network, c.addr, SyslogAuthPriv)
+		if err != nil {
+			t.Fatalf("%s sink:%s", c.network, err.Error())
+		}
+		sink.Audit(ev)
+		sink.Close()
+
+		buf := make([]byte, 2048)
+		c.ln.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := c.ln.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("%s read:%s", c.network, err.Error())
+		}
+		if !syslogLine.Match(buf[:n]) {
+			t.Errorf("%s message %q", c.network, buf[:n])
+		}
+	}
+
+	if _, err := NewSyslogSink("tcp", "127.0.0.1:514", SyslogAuth); err == nil {
+		t.Error("tcp syslog accepted")
+	}
+	if _, err := NewSyslogSink("unix", path, SyslogAuth); err == nil {
+		t.Error("unix stream syslog accepted")
+	}
+}
@@ -9,21 +9,30 @@ import (
 )
 
 func ASCIILoginStart(sess *Session) ([]byte, error) {
+	return authenStart(sess, AuthenTypeASCII, MinorVersionDefault, nil)
+}
+
+func PAPAuthenStart(sess *Session) ([]byte, error) {
+	return authenStart(sess, AuthenTypePAP, MinorVersionOne, sess.Password())
+}
+
+// authenStart builds an obfuscated START packet, startData may hold a password
+// and is wiped once it is in the packet
+func authenStart(sess *Session, authenType, minorVersion uint8, startData []byte) ([]byte, error) {
 	sess.Lock()
 	defer sess.Unlock()
 
 	packet := &AuthenStart{}
-	packet.Header.Version = (MajorVersion | MinorVersionDefault)
+	packet.Header.Version = (MajorVersion | minorVersion)
 	packet.Header.Type = TypeAuthen
-	packet.Header.SeqNo = sess.SessionSeqNo
-	sess.SessionSeqNo++
-	if sess.mng.Config.ConnMultiplexing {
+	packet.Header.SeqNo = sess.nextSeqNo(packet.Header.Version, packet.Header.Type)
+	if sess.pool.config.ConnMultiplexing {
 		packet.Header.Flags |= SingleConnectFlag
 	}
 	packet.Header.SessionID = sess.SessionID
 	packet.Action = AuthenActionLogin
 	packet.PrivLvl = PrivLvlRoot
-	packet.AuthenType = AuthenTypeASCII
+	packet.AuthenType = authenType
 	packet.Service = AuthenServiceLogin
 
 	totalLen := 8
@@ -54,7 +63,10 @@ func ASCIILoginStart(sess *Session) ([]byte, error) {
 	//fmt.Printf("addr:%d\n", int(len(addr)))
 	totalLen += int(packet.RmtAddrLen)
 
-	packet.DataLen = 0
+	packet.DataLen = uint8(len(startData))
+	packet.Data = startData
+	totalLen += int(packet.DataLen)
+
 	packet.Header.Length = uint32(totalLen)
 	//fmt.Printf("total len :%d\n", totalLen)
 
@@ -64,84 +76,191 @@ func ASCIILoginStart(sess *Session) ([]byte, error) {
 		return nil, err
 	} else {
 		//fmt.Printf("total byte :%d\n", len(data))
-		crypt(data, []byte(sess.mng.Config.ShareKey))
+		sess.obfuscate(data)
+		wipe(startData)
 		return data, nil
 	}
 }
 
-func ASCIILoginContinue(sess *Session) error {
+// authenContinue answers a server prompt, version is the one of the START
+// authenContinue sends a CONTINUE packet, userMsg and continueData may hold a
+// password and are wiped once they are in the packet
+func authenContinue(sess *Session, version uint8, userMsg, continueData []byte) error {
+	sess.Lock()
+	restart := sess.restart
+	sess.Unlock()
+	if restart {
+		return errors.New("session seqNo overflow,restart")
+	}
+
 	data := &AuthenContinuePacket{}
-	data.init(sess)
+	data.init(sess, version, userMsg, continueData)
 	Buf, err := data.marshal()
 	if err != nil {
 		fmt.Printf("continue packet marshal fail\n")
 		return errors.New("continue packet marshal fail")
 	} else {
-		crypt(Buf, []byte(sess.mng.Config.ShareKey))
-		sess.t.Lock()
-		defer sess.t.Unlock()
-		if sess.t.Done {
-			return errors.New("transport exit, send continue packet fail")
+		sess.obfuscate(Buf)
+		wipe(userMsg)
+		wipe(continueData)
+		if err := sess.send(Buf); err != nil {
+			return err
 		}
-		sess.t.sendChn <- Buf
 		fmt.Println("send continue packet to transport buffer")
 		return nil
 	}
 }
 
-func ASCIILoginReply(sess *Session, buffer []byte) (bool, error) {
+// authenReply checks and decodes an authen reply and records it as the session result
+func authenReply(sess *Session, buffer []byte) (*AuthenReplyPacket, error) {
 	reply := &AuthenReplyPacket{}
 	(&(reply.Header)).unmarshal(buffer)
 
 	err := reply.varify(sess)
 	if err != nil {
 		fmt.Printf("%s\n", err.Error())
-		return false, err
+		return nil, err
 	}
 	//解密
-	crypt(buffer, []byte(sess.mng.Config.ShareKey))
+	if err := sess.deobfuscate(buffer); err != nil {
+		return nil, err
+	}
 
 	body := buffer[HeaderLen:]
-	reply.unmarshal(body)
-
-	switch reply.Status {
-	case AuthenStatusPass:
-		fmt.Printf("server reply pass\n")
-		return true, nil
+	if err := reply.unmarshal(body); err != nil {
+		fmt.Printf("decode reply fail,%s\n", err.Error())
+		return nil, err
+	}
+	sess.setResult(&Result{
+		Status:    reply.Status,
+		ServerMsg: reply.ServerMsg,
+		Data:      reply.Data,
+		NoEcho:    reply.Flags&ReplyFlagNoEcho != 0,
+	})
+	return reply, nil
+}
 
-	case AuthenStatusFail:
-		fmt.Printf("server reply fail\n")
-		return false, errors.New("server reply fail")
+// Authen runs an authentication exchange of authenType on an open session,
+// the type needs a strategy, see RegisterAuthenStrategy
+func (sess *Session) Authen(authenType uint8) (*Result, error) {
+	err := authenticate(sess, authenType)
+	return sess.lastResult(), err
+}
 
-	case AuthenStatusGetData:
-		fmt.Printf("server reply getdata\n")
-		return false, errors.New("unsupported option,server reply getdata")
+// maxAuthenRestarts bounds how often a server may ask for the exchange to be
+// started over
+const maxAuthenRestarts = 1
 
-	case AuthenStatusGetUser:
-		fmt.Printf("server reply getuser\n")
-		return false, errors.New("unsupported option,server reply getuser")
+// authenticate drives an AuthenMachine with the server replies, the strategy
+// of authenType fills the START and answers the prompts
+func authenticate(sess *Session, authenType uint8) (err error) {
+	defer sess.observe(TypeAuthen, time.Now(), &err)
+	strategy, err := authenStrategy(authenType)
+	if err != nil {
+		return err
+	}
+	if err := sess.begin(); err != nil {
+		return err
+	}
 
-	case AuthenStatusGetPass:
-		fmt.Printf("server reply getpass\n")
-		return false, ASCIILoginContinue(sess)
+	m := NewAuthenMachine()
+	restarts := 0
+	minorVersion, err := sendAuthenStart(sess, m, authenType, strategy)
+	if err != nil {
+		fmt.Printf("%s, authen start fail\n", err.Error())
+		return err
+	}
 
-	case AuthenStatusRestart:
-		fmt.Printf("server reply restart\n")
-		return false, errors.New("unsupported option,server reply restart")
+	//waitting for server reply
+	for {
+		reply := sess.pending()
+		select {
+		case <-reply.done:
+			buffer, err := sess.collect(reply)
+			if err != nil {
+				fmt.Printf("transport fail, %s\n", err.Error())
+				return err
+			}
+			packet, err := authenReply(sess, buffer)
+			if errors.Is(err, ErrBadSecret) && sess.rekey() {
+				//start over with the next shared key
+				m.Reset()
+				if minorVersion, err = sendAuthenStart(sess, m, authenType, strategy); err == nil {
+					continue
+				}
+			}
+			if err == nil {
+				err = m.Reply(packet.Status)
+			}
+			if err != nil {
+				fmt.Printf("authen fail,error %s\n", err.Error())
+				return err
+			}
 
-	case AuthenStatusError:
-		fmt.Printf("server reply error\n")
-		return false, errors.New("server reply error")
+			fmt.Printf("server reply %s\n", m.State())
+			switch m.State() {
+			case AuthenStatePass:
+				fmt.Printf("authen success\n")
+				return nil
+			case AuthenStateFail:
+				return errors.New("server reply fail")
+			case AuthenStateError:
+				return errors.New("server reply error")
+			case AuthenStateRestart:
+				//begin again with a new START under a fresh session ID
+				restarts++
+				if restarts > maxAuthenRestarts {
+					return errors.New("server reply restart again")
+				}
+				if err := sess.renew(); err != nil {
+					return err
+				}
+				if err := m.To(AuthenStateStart); err != nil {
+					return err
+				}
+				if minorVersion, err = sendAuthenStart(sess, m, authenType, strategy); err != nil {
+					return err
+				}
+				continue
+			case AuthenStateFollow:
+				return fmt.Errorf("unsupported option,server reply %s", m.State())
+			}
 
-	case AuthenStatusFollow:
-		fmt.Printf("server reply follow\n")
-		return false, errors.New("unsupported option,server reply follow")
+			userMsg, data, err := strategy.Continue(sess, m.State(), sess.lastResult())
+			if err == nil {
+				err = authenContinue(sess, MajorVersion|minorVersion, userMsg, data)
+			}
+			if err != nil {
+				fmt.Printf("authen fail,error %s\n", err.Error())
+				return err
+			}
+			if err := m.To(AuthenStateAwaitReply); err != nil {
+				return err
+			}
+		case <-time.After(time.Duration(sess.timeout) * time.Second):
+			fmt.Printf("receive reply timeout\n")
+			//关闭连接
+			return ErrTimeout
+		case <-sess.ctx.Done():
+			fmt.Printf("sess close")
+			return errors.New("session close")
+		}
+	}
+}
 
-	default:
-		fmt.Printf("server reply unrecognized,%d\n", reply.Status)
-		msg := fmt.Sprint("%s %d", "server reply unrecognized", reply.Status)
-		return false, errors.New(msg)
+func sendAuthenStart(sess *Session, m *AuthenMachine, authenType uint8, strategy AuthenStrategy) (uint8, error) {
+	minorVersion, startData, err := strategy.Start(sess)
+	if err != nil {
+		return 0, err
+	}
+	data, err := authenStart(sess, authenType, minorVersion, startData)
+	if err != nil {
+		return 0, err
 	}
+	if err := sess.send(data); err != nil {
+		return 0, err
+	}
+	return minorVersion, m.To(AuthenStateAwaitReply)
 }
 
 //5.4.2.1. ASCII Login
@@ -165,62 +284,25 @@ func ASCIILoginReply(sess *Session, buffer []byte) (bool, error) {
 //composed of a single START followed by zero or more pairs of REPLYs
 //and CONTINUEs, followed by a final REPLY indicating PASS, FAIL or
 //ERROR.
-func AuthenASCII(timeout int, username, password string) error {
+func AuthenASCII(timeout int, username, password string) (*Result, error) {
 	if TacacsMng == nil {
-		return errors.New("[tacacs] tacacs hasn't init, Authen fail, exit!")
+		return nil, errors.New("[tacacs] tacacs hasn't init, Authen fail, exit!")
 	} else {
 		sess, err := NewSession(TacacsMng.ctx, timeout, username, password)
 		if err != nil {
 			fmt.Printf("[tacacs] new session fail, %s", err.Error())
-			return err
-		} else {
-			//prepare the start packet
-			data, err := ASCIILoginStart(sess)
-			if err != nil {
-				fmt.Printf("[tacacs] new session fail, %s", err.Error())
-				sess.close()
-				return err
-			} else {
-				sess.t.Lock()
-				if !sess.t.Done {
-					sess.t.sendChn <- data
-				} else {
-					fmt.Println("transport buffer closed, ASCIIAuthen fail")
-					sess.t.Unlock()
-					sess.close()
-					return errors.New("transport buffer closed, ASCIIAuthen fail")
-				}
-				sess.t.Unlock()
-
-				//waitting for server reply
-				for {
-					select {
-					case buffer := <-sess.ReadBuffer:
-						done, err := ASCIILoginReply(sess, buffer)
-						if err != nil {
-							sess.close()
-							fmt.Printf("authen fail,error %s\n", err.Error())
-							return err
-						} else if done {
-							fmt.Printf("authen success\n")
-							return nil
-						}
-					case <-time.After(time.Duration(sess.timeout) * time.Second):
-						fmt.Printf("receive reply timeout\n")
-						//关闭连接
-						sess.close()
-						return errors.New("timeout")
-					case <-sess.ctx.Done():
-						fmt.Printf("sess close")
-						sess.close()
-						return errors.New("session close")
-					}
-				}
-			}
+			return nil, err
 		}
+		defer sess.Close()
+		return sess.AuthenASCII()
 	}
 }
 
+// AuthenASCII runs an authentication exchange on an open session
+func (sess *Session) AuthenASCII() (*Result, error) {
+	return sess.Authen(AuthenTypeASCII)
+}
+
 //5.4.2.2. PAP Login
 //
 //action = TAC_PLUS_AUTHEN_LOGIN
@@ -232,179 +314,23 @@ func AuthenASCII(timeout int, username, password string) error {
 //field MUST contain the PAP ASCII password. A PAP authentication only
 //consists of a username and password RFC 1334 [RFC1334] . The REPLY
 //from the server MUST be either a PASS, FAIL or ERROR.
-func AuthenPAP(timeout int, username, password string) error {
+func AuthenPAP(timeout int, username, password string) (*Result, error) {
 	if TacacsMng == nil {
-		return errors.New("[tacacs] tacacs hasn't init, AuthenPAP fail, exit!")
+		return nil, errors.New("[tacacs] tacacs hasn't init, AuthenPAP fail, exit!")
 	} else {
 		sess, err := NewSession(TacacsMng.ctx, timeout, username, password)
 		if err != nil {
 			fmt.Printf("[tacacs] new session fail, %s", err.Error())
-			return err
-		} else {
-			//prepare the start packet
-			data, err := PAPAuthenStart(sess)
-			if err != nil {
-				fmt.Printf("[tacacs] new session fail, %s", err.Error())
-				sess.close()
-				return err
-			} else {
-				sess.t.Lock()
-				if !sess.t.Done {
-					sess.t.sendChn <- data
-				} else {
-					fmt.Println("transport buffer closed, PAPAuthen fail")
-					sess.t.Unlock()
-					sess.close()
-					return errors.New("transport buffer closed, PAPAuthen fail")
-				}
-				sess.t.Unlock()
-
-				//waitting for server reply
-				for {
-					select {
-					case buffer := <-sess.ReadBuffer:
-						done, err := PAPAuthenReply(sess, buffer)
-						if err != nil {
-							sess.close()
-							fmt.Printf("authen fail,error %s\n", err.Error())
-							return err
-						} else if done {
-							fmt.Printf("authen PAP success\n")
-							return nil
-						}
-					case <-time.After(time.Duration(sess.timeout) * time.Second):
-						fmt.Printf("receive reply timeout\n")
-						//关闭连接
-						sess.close()
-						return errors.New("timeout")
-					case <-sess.ctx.Done():
-						fmt.Printf("sess close")
-						sess.close()
-						return errors.New("session close")
-					}
-				}
-			}
+			return nil, err
 		}
+		defer sess.Close()
+		return sess.AuthenPAP()
 	}
 }
 
-func PAPAuthenStart(sess *Session) ([]byte, error) {
-	sess.Lock()
-	defer sess.Unlock()
-
-	packet := &AuthenStart{}
-	packet.Header.Version = (MajorVersion | MinorVersionOne)
-	packet.Header.Type = TypeAuthen
-	packet.Header.SeqNo = sess.SessionSeqNo
-	sess.SessionSeqNo++
-	if sess.mng.Config.ConnMultiplexing {
-		packet.Header.Flags |= SingleConnectFlag
-	}
-	packet.Header.SessionID = sess.SessionID
-	packet.Action = AuthenActionLogin
-	packet.PrivLvl = PrivLvlRoot
-	packet.AuthenType = AuthenTypePAP
-	packet.Service = AuthenServiceLogin
-
-	totalLen := 8
-	packet.UserLen = uint8(len(sess.UserName))
-	packet.User = sess.UserName
-	totalLen += int(packet.UserLen)
-	//fmt.Printf("userLen:%d\n", int(packet.UserLen))
-
-	port, err := GetPort(sess.t.netConn.nc.LocalAddr().String())
-	if err != nil {
-		fmt.Printf("GetPort Fail:%s\n", err.Error())
-	} else {
-		packet.Port = strconv.FormatUint(uint64(port), 16)
-		//fmt.Printf("LocalPort : %d\n", port)
-	}
-	packet.PortLen = uint8(len(packet.Port))
-	//fmt.Printf("portLen:%d\n", int(len(packet.Port)))
-	totalLen += int(packet.PortLen)
-
-	addr, err := GetIP(sess.t.netConn.nc.LocalAddr().String())
-	if err != nil {
-		fmt.Printf("GetIP fail,%s\n", err.Error())
-		packet.RmtAddrLen = 0
-	} else {
-		packet.RmtAddr = addr
-		packet.RmtAddrLen = uint8(len(addr))
-	}
-	//fmt.Printf("addr:%d\n", int(len(addr)))
-	totalLen += int(packet.RmtAddrLen)
-
-	packet.DataLen = uint8(len(sess.Password))
-	packet.Data = sess.Password
-	totalLen += int(packet.DataLen)
-
-	packet.Header.Length = uint32(totalLen)
-	//fmt.Printf("total len :%d\n", totalLen)
-
-	data, err := packet.marshal()
-	if err != nil {
-		fmt.Printf("packet marshal fail, error msg :%s\n", err.Error())
-		return nil, err
-	} else {
-		//fmt.Printf("total byte :%d\n", len(data))
-		crypt(data, []byte(sess.mng.Config.ShareKey))
-		return data, nil
-	}
-}
-
-func PAPAuthenReply(sess *Session, buffer []byte) (bool, error) {
-	reply := &AuthenReplyPacket{}
-	(&(reply.Header)).unmarshal(buffer)
-
-	err := reply.varify(sess)
-	if err != nil {
-		fmt.Printf("%s\n", err.Error())
-		return false, err
-	}
-	//解密
-	crypt(buffer, []byte(sess.mng.Config.ShareKey))
-
-	body := buffer[HeaderLen:]
-	reply.unmarshal(body)
-
-	switch reply.Status {
-	case AuthenStatusPass:
-		fmt.Printf("server reply pass\n")
-		return true, nil
-
-	case AuthenStatusFail:
-		fmt.Printf("server reply fail\n")
-		return false, errors.New("server reply fail")
-
-	case AuthenStatusGetData:
-		fmt.Printf("server reply getdata\n")
-		return false, errors.New("unsupported option,server reply getdata")
-
-	case AuthenStatusGetUser:
-		fmt.Printf("server reply getuser\n")
-		return false, errors.New("unsupported option,server reply getuser")
-
-	case AuthenStatusGetPass:
-		fmt.Printf("server reply getpass\n")
-		return false, errors.New("unsupported option,server reply getPass")
-
-	case AuthenStatusRestart:
-		fmt.Printf("server reply restart\n")
-		return false, errors.New("unsupported option,server reply restart")
-
-	case AuthenStatusError:
-		fmt.Printf("server reply error\n")
-		return false, errors.New("server reply error")
-
-	case AuthenStatusFollow:
-		fmt.Printf("server reply follow\n")
-		return false, errors.New("unsupported option,server reply follow")
-
-	default:
-		fmt.Printf("server reply unrecognized,%d\n", reply.Status)
-		msg := fmt.Sprint("%s %d", "server reply unrecognized", reply.Status)
-		return false, errors.New(msg)
-	}
+// AuthenPAP runs an authentication exchange on an open session
+func (sess *Session) AuthenPAP() (*Result, error) {
+	return sess.Authen(AuthenTypePAP)
 }
 
 //5.4.2.3. CHAP login
@@ -19,14 +19,14 @@ func TestSingleConn(t *testing.T) {
 	TacacsInit()
 	TacacsConfigSet(config)
 
-	err := AuthenASCII(10, "mason", "0000")
+	_, err := AuthenASCII(10, "mason", "0000")
 	if err != nil {
 		fmt.Println("authen fail, error msg :" + err.Error())
 	} else {
 		fmt.Println("authen ascii success")
 	}
 
-	err = AuthenASCII(10, "mason", "0000")
+	_, err = AuthenASCII(10, "mason", "0000")
 	if err != nil {
 		fmt.Println("authen fail, error msg :" + err.Error())
 	} else {
@@ -36,7 +36,7 @@ func TestSingleConn(t *testing.T) {
 	/*
 		go func() {
 			for i := 0; i < 5; i++ {
-				err := AuthenASCII(10, "mason", "0000")
+				_, err := AuthenASCII(10, "mason", "0000")
 				if err != nil {
 					fmt.Println("authen fail, error msg :" + err.Error())
 				} else {
@@ -62,7 +62,7 @@ func TestAuthenPAP(t *testing.T) {
 	TacacsInit()
 	TacacsConfigSet(config)
 
-	err := AuthenPAP(10, "dddd", "0000")
+	_, err := AuthenPAP(10, "dddd", "0000")
 	if err != nil {
 		fmt.Println("AuthenPAP fail, error msg :" + err.Error())
 	} else {
@@ -86,7 +86,7 @@ func TestAuthenASCII(t *testing.T) {
 	TacacsInit()
 	TacacsConfigSet(config)
 
-	err := AuthenASCII(10, "mason", "0000")
+	_, err := AuthenASCII(10, "mason", "0000")
 	if err != nil {
 		fmt.Println("authen fail, error msg :" + err.Error())
 	} else {
@@ -0,0 +1,240 @@
+// authenstate.go
+package tacacs
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// AuthenState is where an authentication exchange stands. The client drives
+// the machine with the replies it reads, a server with the replies it writes
+type AuthenState uint8
+
+const (
+	// AuthenStateStart is a fresh exchange, no START has been sent
+	AuthenStateStart AuthenState = iota
+	// AuthenStateAwaitReply waits for the server to answer a START or CONTINUE
+	AuthenStateAwaitReply
+	// AuthenStateNeedUser, NeedPass and NeedData wait for the client to CONTINUE
+	AuthenStateNeedUser
+	AuthenStateNeedPass
+	AuthenStateNeedData
+	// the states below end the exchange
+	AuthenStatePass
+	AuthenStateFail
+	AuthenStateError
+	AuthenStateRestart
+	AuthenStateFollow
+)
+
+func (s AuthenState) String() string {
+	switch s {
+	case AuthenStateStart:
+		return "start"
+	case AuthenStateAwaitReply:
+		return "await-reply"
+	case AuthenStateNeedUser:
+		return "need-user"
+	case AuthenStateNeedPass:
+		return "need-pass"
+	case AuthenStateNeedData:
+		return "need-data"
+	case AuthenStatePass:
+		return "pass"
+	case AuthenStateFail:
+		return "fail"
+	case AuthenStateError:
+		return "error"
+	case AuthenStateRestart:
+		return "restart"
+	case AuthenStateFollow:
+		return "follow"
+	default:
+		return "unknown(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Final reports whether the exchange is over once in state s
+func (s AuthenState) Final() bool {
+	return s >= AuthenStatePass && s <= AuthenStateFollow
+}
+
+// Status is the authen reply status that moves an exchange into s, 0 for the
+// states a server doesn't reply with
+func (s AuthenState) Status() uint8 {
+	switch s {
+	case AuthenStateNeedUser:
+		return AuthenStatusGetUser
+	case AuthenStateNeedPass:
+		return AuthenStatusGetPass
+	case AuthenStateNeedData:
+		return AuthenStatusGetData
+	case AuthenStatePass:
+		return AuthenStatusPass
+	case AuthenStateFail:
+		return AuthenStatusFail
+	case AuthenStateError:
+		return AuthenStatusError
+	case AuthenStateRestart:
+		return AuthenStatusRestart
+	case AuthenStateFollow:
+		return AuthenStatusFollow
+	default:
+		return 0
+	}
+}
+
+// authenStateOf maps an authen reply status to the state it moves to
+func authenStateOf(status uint8) (AuthenState, bool) {
+	switch status {
+	case AuthenStatusGetUser:
+		return AuthenStateNeedUser, true
+	case AuthenStatusGetPass:
+		return AuthenStateNeedPass, true
+	case AuthenStatusGetData:
+		return AuthenStateNeedData, true
+	case AuthenStatusPass:
+		return AuthenStatePass, true
+	case AuthenStatusFail:
+		return AuthenStateFail, true
+	case AuthenStatusError:
+		return AuthenStateError, true
+	case AuthenStatusRestart:
+		return AuthenStateRestart, true
+	case AuthenStatusFollow:
+		return AuthenStateFollow, true
+	default:
+		return 0, false
+	}
+}
+
+// authenTransitions lists the legal moves out of each state. A START leads to
+// a REPLY, a REPLY either ends the exchange or asks for a CONTINUE, and a
+// RESTART lets the client begin again with a new START
+var authenTransitions = map[AuthenState][]AuthenState{
+	AuthenStateStart: {AuthenStateAwaitReply},
+	AuthenStateAwaitReply: {AuthenStateNeedUser, AuthenStateNeedPass, AuthenStateNeedData,
+		AuthenStatePass, AuthenStateFail, AuthenStateError, AuthenStateRestart, AuthenStateFollow},
+	AuthenStateNeedUser: {AuthenStateAwaitReply},
+	AuthenStateNeedPass: {AuthenStateAwaitReply},
+	AuthenStateNeedData: {AuthenStateAwaitReply},
+	AuthenStateRestart:  {AuthenStateStart},
+}
+
+// AuthenMachine follows one authentication exchange and refuses moves the
+// draft doesn't allow. It isn't safe for concurrent use, an exchange has a
+// single driver
+type AuthenMachine struct {
+	state AuthenState
+}
+
+// NewAuthenMachine returns a machine in AuthenStateStart
+func NewAuthenMachine() *AuthenMachine {
+	return &AuthenMachine{state: AuthenStateStart}
+}
+
+// State returns the current state
+func (m *AuthenMachine) State() AuthenState {
+	return m.state
+}
+
+// To moves the machine to next, an illegal move is a ProtocolError and leaves
+// the state untouched
+func (m *AuthenMachine) To(next AuthenState) error {
+	for _, s := range authenTransitions[m.state] {
+		if s == next {
+			m.state = next
+			return nil
+		}
+	}
+	return &ProtocolError{Reason: fmt.Sprintf("authen %s can't move to %s", m.state, next)}
+}
+
+// Reply moves the machine by the status of an authen reply
+func (m *AuthenMachine) Reply(status uint8) error {
+	next, ok := authenStateOf(status)
+	if !ok {
+		return &ProtocolError{Reason: fmt.Sprintf("unknown authen status %d", status)}
+	}
+	return m.To(next)
+}
+
+// Reset puts the machine back to AuthenStateStart, for an exchange that starts
+// over from scratch such as after switching to the next shared key
+func (m *AuthenMachine) Reset() {
+	m.state = AuthenStateStart
+}
+
+// AuthenStrategy is the client side of one authen_type, it fills the START
+// packet and answers whatever the server asks for along the way. The slices
+// returned are wiped once they are in the packet, so they must not be shared.
+type AuthenStrategy interface {
+	// Start returns the minor version and data field of the START packet
+	Start(sess *Session) (minorVersion uint8, data []byte, err error)
+	// Continue returns the user_msg and data of the CONTINUE packet answering
+	// state, which is one of NeedUser, NeedPass and NeedData, reply holds the
+	// server prompt
+	Continue(sess *Session, state AuthenState, reply *Result) (userMsg, data []byte, err error)
+}
+
+var (
+	strategyMu       sync.RWMutex
+	authenStrategies = map[uint8]AuthenStrategy{
+		AuthenTypeASCII: asciiStrategy{},
+		AuthenTypePAP:   papStrategy{},
+	}
+)
+
+// RegisterAuthenStrategy plugs s in for authenType, replacing what was there,
+// so that Session.Authen and Login can use it
+func RegisterAuthenStrategy(authenType uint8, s AuthenStrategy) {
+	strategyMu.Lock()
+	defer strategyMu.Unlock()
+	if s == nil {
+		delete(authenStrategies, authenType)
+		return
+	}
+	authenStrategies[authenType] = s
+}
+
+func authenStrategy(authenType uint8) (AuthenStrategy, error) {
+	strategyMu.RLock()
+	defer strategyMu.RUnlock()
+	s, ok := authenStrategies[authenType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported authen type %d", authenType)
+	}
+	return s, nil
+}
+
+// asciiStrategy sends the username in the START and answers GETUSER and
+// GETPASS prompts through user_msg
+type asciiStrategy struct{}
+
+func (asciiStrategy) Start(sess *Session) (uint8, []byte, error) {
+	return MinorVersionDefault, nil, nil
+}
+
+func (asciiStrategy) Continue(sess *Session, state AuthenState, reply *Result) ([]byte, []byte, error) {
+	switch state {
+	case AuthenStateNeedUser:
+		return []byte(sess.UserName), nil, nil
+	case AuthenStateNeedPass:
+		return sess.Password(), nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported option,server reply %s", state)
+	}
+}
+
+// papStrategy carries the password in the START, the server must answer
+// with a final reply
+type papStrategy struct{}
+
+func (papStrategy) Start(sess *Session) (uint8, []byte, error) {
+	return MinorVersionOne, sess.Password(), nil
+}
+
+func (papStrategy) Continue(sess *Session, state AuthenState, reply *Result) ([]byte, []byte, error) {
+	return nil, nil, fmt.Errorf("unsupported option,server reply %s", state)
+}
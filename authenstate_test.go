@@ -0,0 +1,203 @@
+// authenstate_test
+package tacacs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// startData returns the authen_type and data field of an authen START body
+func startData(body []byte) (uint8, string) {
+	offset := 8 + int(body[4]) + int(body[5]) + int(body[6])
+	return body[2], string(body[offset : offset+int(body[7])])
+}
+
+// continueFields returns the user_msg and data of an authen CONTINUE body
+func continueFields(body []byte) (string, string) {
+	msgLen := int(binary.BigEndian.Uint16(body))
+	dataLen := int(binary.BigEndian.Uint16(body[2:]))
+	return string(body[5 : 5+msgLen]), string(body[5+msgLen : 5+msgLen+dataLen])
+}
+
+func TestAuthenMachine(t *testing.T) {
+	m := NewAuthenMachine()
+	if m.State() != AuthenStateStart {
+		t.Fatalf("new machine in %s", m.State())
+	}
+	if err := m.Reply(AuthenStatusPass); err == nil {
+		t.Fatal("reply before START accepted")
+	}
+	steps := []AuthenState{AuthenStateAwaitReply, AuthenStateNeedUser, AuthenStateAwaitReply,
+		AuthenStateNeedPass, AuthenStateAwaitReply, AuthenStateRestart, AuthenStateStart}
+	for _, s := range steps {
+		if err := m.To(s); err != nil {
+			t.Fatalf("move to %s:%s", s, err.Error())
+		}
+	}
+
+	m.Reset()
+	m.To(AuthenStateAwaitReply)
+	if err := m.Reply(AuthenStatusPass); err != nil {
+		t.Fatalf("pass reply:%s", err.Error())
+	}
+	var perr *ProtocolError
+	if err := m.To(AuthenStateAwaitReply); !errors.As(err, &perr) {
+		t.Fatalf("continue after pass, %v", err)
+	}
+	if m.State() != AuthenStatePass || !m.State().Final() {
+		t.Errorf("illegal move left %s", m.State())
+	}
+
+	m.Reset()
+	m.To(AuthenStateAwaitReply)
+	if err := m.Reply(0x7f); err == nil {
+		t.Error("unknown status accepted")
+	}
+
+	for s := AuthenStateStart; s <= AuthenStateFollow; s++ {
+		if status := s.Status(); status != 0 {
+			if back, ok := authenStateOf(status); !ok || back != s {
+				t.Errorf("%s maps to status %d and back to %s", s, status, back)
+			}
+		}
+		if s.Final() != (s >= AuthenStatePass) {
+			t.Errorf("%s final %v", s, s.Final())
+		}
+	}
+}
+
+func TestAuthenPrompts(t *testing.T) {
+	var mu sync.Mutex
+	var answers []string
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		if hdr.SeqNo == 1 {
+			c.reply(hdr, authenReplyBody(AuthenStatusGetUser, "Username: ", ""))
+			return
+		}
+		msg, _ := continueFields(body)
+		mu.Lock()
+		answers = append(answers, msg)
+		mu.Unlock()
+		if hdr.Version != MajorVersion|MinorVersionDefault {
+			c.reply(hdr, authenReplyBody(AuthenStatusError, "bad version", ""))
+		} else if hdr.SeqNo == 3 {
+			c.reply(hdr, authenReplyBody(AuthenStatusGetPass, "Password: ", ""))
+		} else {
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		}
+	})
+	fakeInit(t, s)
+
+	if _, err := AuthenASCII(5, "alice", "secret"); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(answers) != 2 || answers[0] != "alice" || answers[1] != "secret" {
+		t.Errorf("continue user_msg %q", answers)
+	}
+
+	//PAP is a single START and REPLY, a prompt ends it
+	if _, err := AuthenPAP(5, "alice", "secret"); err == nil {
+		t.Error("PAP answered a prompt")
+	}
+}
+
+// chapStrategy stands in for a pluggable authen_type, it sends its data in
+// the START and answers GETDATA
+type chapStrategy struct{}
+
+func (chapStrategy) Start(sess *Session) (uint8, []byte, error) {
+	return MinorVersionOne, []byte("challenge"), nil
+}
+
+func (chapStrategy) Continue(sess *Session, state AuthenState, reply *Result) ([]byte, []byte, error) {
+	if state != AuthenStateNeedData {
+		return nil, nil, errors.New("unexpected " + state.String())
+	}
+	return nil, []byte("response to " + reply.ServerMsg), nil
+}
+
+func TestAuthenStrategy(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		if hdr.Version != MajorVersion|MinorVersionOne {
+			c.reply(hdr, authenReplyBody(AuthenStatusError, "bad version", ""))
+			return
+		}
+		if hdr.SeqNo == 1 {
+			if typ, data := startData(body); typ != AuthenTypeCHAP || data != "challenge" {
+				c.reply(hdr, authenReplyBody(AuthenStatusFail, "bad start", ""))
+				return
+			}
+			c.reply(hdr, authenReplyBody(AuthenStatusGetData, "nonce", ""))
+			return
+		}
+		if _, data := continueFields(body); data != "response to nonce" {
+			c.reply(hdr, authenReplyBody(AuthenStatusFail, "bad data", ""))
+			return
+		}
+		c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+	})
+	fakeInit(t, s)
+
+	sess, err := NewSession(context.Background(), 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	if _, err := sess.Authen(AuthenTypeCHAP); err == nil {
+		t.Fatal("authen with no strategy registered")
+	}
+
+	RegisterAuthenStrategy(AuthenTypeCHAP, chapStrategy{})
+	defer RegisterAuthenStrategy(AuthenTypeCHAP, nil)
+	r, err := sess.Authen(AuthenTypeCHAP)
+	if err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	if r.Status != AuthenStatusPass {
+		t.Errorf("status %d", r.Status)
+	}
+}
+
+func TestAuthenRestart(t *testing.T) {
+	var mu sync.Mutex
+	var starts []uint32
+	restartAlways := false
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		mu.Lock()
+		starts = append(starts, hdr.SessionID)
+		restart := restartAlways || len(starts) == 1
+		mu.Unlock()
+		if restart {
+			c.reply(hdr, authenReplyBody(AuthenStatusRestart, "", ""))
+			return
+		}
+		c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+	})
+	fakeInit(t, s)
+
+	if _, err := AuthenPAP(5, "alice", "secret"); err != nil {
+		t.Fatalf("authen after restart fail:%s", err.Error())
+	}
+	mu.Lock()
+	if len(starts) != 2 || starts[0] == starts[1] {
+		t.Errorf("START session ids %v, expect two different ones", starts)
+	}
+	starts = nil
+	restartAlways = true
+	mu.Unlock()
+
+	//a server that keeps asking for a restart isn't followed forever
+	if _, err := AuthenPAP(5, "alice", "secret"); err == nil {
+		t.Error("endless restart accepted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(starts) != maxAuthenRestarts+1 {
+		t.Errorf("%d STARTs", len(starts))
+	}
+}
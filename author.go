@@ -29,9 +29,10 @@ func AuthorStart(sess *Session, authorMethod, privLvl, authorType, authorSvc uin
 	p := &AuthorRequest{}
 	p.Header.Version = (MajorVersion | MinorVersionDefault)
 	p.Header.Type = TypeAuthor
-	p.Header.SeqNo = sess.SessionSeqNo
-	sess.SessionSeqNo++
-	if sess.mng.Config.ConnMultiplexing {
+	sess.Lock()
+	p.Header.SeqNo = sess.nextSeqNo(p.Header.Version, p.Header.Type)
+	sess.Unlock()
+	if sess.pool.config.ConnMultiplexing {
 		p.Header.Flags |= SingleConnectFlag
 	}
 	p.Header.SessionID = sess.SessionID
@@ -64,7 +65,7 @@ func AuthorStart(sess *Session, authorMethod, privLvl, authorType, authorSvc uin
 	if p.ArgCnt != 0 {
 		p.Header.Length += uint32(len(AttrValuePair))
 		for _, arg := range AttrValuePair {
-			fmt.Printf("arg:%s,len:%d\n", arg, len(arg))
+			fmt.Printf("arg:%s,len:%d\n", redactArg(arg), len(arg))
 			p.Header.Length += uint32(len(arg))
 		}
 	}
@@ -85,19 +86,35 @@ func AuthorStart(sess *Session, authorMethod, privLvl, authorType, authorSvc uin
 		buf = append(buf, arg...)
 	}
 	fmt.Printf("len(AuthorRequest):%d\n", len(buf))
-	crypt(buf, []byte(sess.mng.Config.ShareKey))
+	sess.obfuscate(buf)
 	return buf
 }
 
 func AuthorResponse(sess *Session, data []byte) error {
+	_, err := authorResponse(sess, data)
+	return err
+}
+
+// authorResponse checks and decodes a reply, the reply is returned along with
+// the error its status maps to once it is valid
+func authorResponse(sess *Session, data []byte) (*AuthorReply, error) {
 	p := &AuthorReply{}
-	crypt(data, []byte(sess.mng.Config.ShareKey))
-	p.unmarshal(data)
+	//the header is in the clear, check it before the body is decoded
+	if err := (&p.Header).unmarshal(data); err != nil {
+		return nil, err
+	}
+	if err := p.SanityCheck(sess, data); err != nil {
+		return nil, err
+	}
 
-	err := p.SanityCheck(sess, data)
-	if err != nil {
-		return err
+	if err := sess.deobfuscate(data); err != nil {
+		return nil, err
 	}
+	if err := p.unmarshal(data); err != nil {
+		fmt.Printf("decode reply fail,%s\n", err.Error())
+		return nil, err
+	}
+	sess.setResult(&Result{Status: p.Status, ServerMsg: p.ServerMsg, Data: p.Data, Args: p.Args})
 
 	switch p.Status {
 	//
@@ -109,7 +126,7 @@ func AuthorResponse(sess *Session, data []byte) error {
 
 		fmt.Printf("Author success\n")
 
-		return nil
+		return p, nil
 	//
 	//If the status equals TAC_PLUS_AUTHOR_STATUS_PASS_REPL then the
 	//arguments in the request are to be completely replaced by the
@@ -117,52 +134,72 @@ func AuthorResponse(sess *Session, data []byte) error {
 	//
 	case AuthorStatusPassREPL:
 		fmt.Printf("Server Response REPLACE	")
-		return nil
+		return p, nil
 	case AuthorStatusFail:
-		return errors.New("Server Response Fail")
+		return p, errors.New("Server Response Fail")
 	case AuthorStatusError:
-		return errors.New("Server Response Error")
+		return p, errors.New("Server Response Error")
 	case AuthorStatusFollow:
-		return errors.New("Server Response Follow")
+		return p, errors.New("Server Response Follow")
 	default:
 		fmt.Printf("unsupported author response status:%d\n", p.Status)
-		return errors.New("unsupported author response status")
+		return p, errors.New("unsupported author response status")
 	}
 }
 
-func Author(sess *Session, authorMethod, privLvl, authorType, authorSvc uint8, AttrValuePair ...string) error {
+// Author returns the final reply of the server along with the error, the
+// result is nil when no reply could be decoded
+func Author(sess *Session, authorMethod, privLvl, authorType, authorSvc uint8, AttrValuePair ...string) (*Result, error) {
+	_, err := author(sess, authorMethod, privLvl, authorType, authorSvc, AttrValuePair...)
+	return sess.lastResult(), err
+}
+
+// author runs an authorization exchange and returns the final reply, nil when
+// none was received
+func author(sess *Session, authorMethod, privLvl, authorType, authorSvc uint8, AttrValuePair ...string) (_ *AuthorReply, err error) {
+	defer sess.observe(TypeAuthor, time.Now(), &err, AttrValuePair...)
+	if err := sess.begin(); err != nil {
+		return nil, err
+	}
 
 	//prepare the start packet
 	data := AuthorStart(sess, authorMethod, privLvl, authorType, authorSvc, AttrValuePair...)
-	sess.t.Lock()
-	if !sess.t.Done {
-		fmt.Printf("write len:%d\n", len(data))
-		sess.t.sendChn <- data
-	} else {
-		fmt.Println("transport buffer closed, ASCIIAuthen fail")
-		sess.t.Unlock()
-		sess.close()
-		return errors.New("transport buffer closed, ASCIIAuthen fail")
+	if err := sess.send(data); err != nil {
+		fmt.Printf("%s, Author fail\n", err.Error())
+		return nil, err
 	}
-	sess.t.Unlock()
 
 	//waitting for server reply
 	for {
+		reply := sess.pending()
 		select {
-		case buffer := <-sess.ReadBuffer:
+		case <-reply.done:
+			buffer, err := sess.collect(reply)
+			if err != nil {
+				fmt.Printf("transport fail, %s\n", err.Error())
+				return nil, err
+			}
 			fmt.Println("receive author reply,len:", len(buffer))
-			return AuthorResponse(sess, buffer)
+			p, err := authorResponse(sess, buffer)
+			if errors.Is(err, ErrBadSecret) && sess.rekey() {
+				//start over with the next shared key
+				data = AuthorStart(sess, authorMethod, privLvl, authorType, authorSvc, AttrValuePair...)
+				if err = sess.send(data); err == nil {
+					continue
+				}
+			}
+			return p, err
 
 		case <-time.After(time.Duration(sess.timeout) * time.Second):
 			fmt.Printf("receive reply timeout\n")
 			//关闭连接
 			//sess.close()
-			return errors.New("timeout")
+			return nil, ErrTimeout
 
 		case <-sess.ctx.Done():
 			fmt.Printf("sess close")
 			//sess.close()
-			return errors.New("session close")
+			return nil, errors.New("session close")
 		}
 	}
 }
@@ -21,7 +21,7 @@ func TestAuthor(t *testing.T) {
 	if err != nil {
 		fmt.Printf("Author fail due to NewSession failure")
 	}
-	err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell", "cmd=enable")
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell", "cmd=enable")
 
 	if err != nil {
 		fmt.Println("Author fail, error msg :" + err.Error())
@@ -8,9 +8,27 @@ import (
 	"net"
 	"strconv"
 	"sync"
-	//	"time"
+	"time"
 )
 
+const (
+	DefaultDialTimeout = 5 * time.Second
+)
+
+// ConfigError reports a socket option of the TacacsConfig that couldn't be
+// applied, the dial fails before any server is asked
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return "config error, " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
 type conn struct {
 	sync.RWMutex
 	nc net.Conn
@@ -18,11 +36,52 @@ type conn struct {
 	ctx context.Context
 }
 
+// network maps IPtype to the dial network, "", "ip" and "tcp" dial both
+// address families and any other unknown value is an error
+func network(config TacacsConfig) (string, error) {
+	switch config.IPtype {
+	case "ip4", "tcp4":
+		return "tcp4", nil
+	case "ip6", "tcp6":
+		return "tcp6", nil
+	case "", "ip", "tcp":
+		return "tcp", nil
+	}
+	return "", errors.New("invalid IPtype " + config.IPtype)
+}
+
 func (c *conn) connect(config TacacsConfig) error {
+	nw, err := network(config)
+	if err != nil {
+		return err
+	}
+
+	if config.ServerPort == 0 {
+		return errors.New("invalid server port")
+	}
+	addr := net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10))
+
+	if config.DialFunc != nil {
+		timeout := config.DialTimeout
+		if timeout == 0 {
+			timeout = DefaultDialTimeout
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, timeout)
+		defer cancel()
+
+		nc, err := config.DialFunc(ctx, nw, addr)
+		if err != nil {
+			fmt.Printf("Create connection %s fail:%s\n", addr, err.Error())
+			return err
+		}
+		c.nc = nc
+		return nil
+	}
+
 	dialer := net.Dialer{}
 	if config.LocalPort != 0 {
 		LocalAddr := net.JoinHostPort(config.LocalIP, strconv.FormatUint(uint64(config.LocalPort), 10))
-		addr, err := net.ResolveTCPAddr("tcp", LocalAddr)
+		addr, err := net.ResolveTCPAddr(nw, LocalAddr)
 		if err != nil {
 			return err
 		}
@@ -30,23 +89,22 @@ func (c *conn) connect(config TacacsConfig) error {
 		dialer.LocalAddr = addr
 	}
 
-	// var idle time.Duration
-	// if address.IdleTime == 0 {
-	// 	idle = DefaultIdleTime
-	// } else {
-	// 	idle = time.Duration(address.IdleTime) * time.Second
-	// }
-	// dialer.Timeout = idle
+	dialer.Timeout = config.DialTimeout
+	if dialer.Timeout == 0 {
+		dialer.Timeout = DefaultDialTimeout
+	}
 
-	//var keepAlive time.Duration
-	//keepAlive = time.Second * 3
-	//dialer.KeepAlive = keepAlive
+	//zero keeps the default probe interval, negative turns keepalive off
+	dialer.KeepAlive = config.KeepAlive
 
-	if config.ServerPort == 0 {
-		return errors.New("invalid server port")
+	dialer.Control, err = control(config)
+	if err != nil {
+		return err
 	}
 
-	nc, err := dialer.DialContext(c.ctx, "tcp", net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10)))
+	//a hostname is resolved on every dial so reconnects follow DNS changes, with
+	//both families allowed the addresses are raced and the loser is dropped
+	nc, err := dialer.DialContext(c.ctx, nw, addr)
 	if err != nil {
 		fmt.Printf("Create tcp connection %s : %d  fail:%s", config.ServerIP, config.ServerPort, err.Error())
 		return err
@@ -61,7 +119,16 @@ func newConn(ctx context.Context, config TacacsConfig) (*conn, error) {
 	c := &conn{}
 	c.ctx = ctx
 
+	start := time.Now()
 	err := c.connect(config)
+	if config.Tracer != nil {
+		ev := ConnectEvent{Start: start, Duration: time.Since(start), Err: err}
+		ev.Server = net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10))
+		if err == nil {
+			ev.Local = c.nc.LocalAddr().String()
+		}
+		config.Tracer.OnConnect(ev)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,123 @@
+// conn_test
+package tacacs
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNetwork(t *testing.T) {
+	for iptype, expect := range map[string]string{"ip4": "tcp4", "ip6": "tcp6", "": "tcp"} {
+		nw, err := network(TacacsConfig{IPtype: iptype})
+		if err != nil || nw != expect {
+			t.Errorf("IPtype %q dials %q (%v), expect %q", iptype, nw, err, expect)
+		}
+	}
+	if _, err := network(TacacsConfig{IPtype: "ipx"}); err == nil {
+		t.Errorf("invalid IPtype accepted")
+	}
+}
+
+func TestConnIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback:%s", err.Error())
+	}
+
+	var mu sync.Mutex
+	var remAddr string
+	s := serveFake(ln, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		mu.Lock()
+		remAddr = authorRemAddr(body)
+		mu.Unlock()
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session over IPv6 fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author over IPv6 fail:%s", err.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if remAddr != "::1" {
+		t.Errorf("rem_addr %q, expect ::1", remAddr)
+	}
+}
+
+func TestConnFamily(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	//an IPv4 server is out of reach when IPv6 is forced
+	config := s.config()
+	config.IPtype = "ip6"
+	TacacsConfigSet(config)
+	if _, err := NewSession(TacacsMng.ctx, 1, "alice", ""); err == nil {
+		t.Errorf("IPv4 server reached over tcp6")
+	}
+
+	//a hostname is resolved when dialing, and on both families by default
+	config.IPtype = ""
+	config.ServerIP = "localhost"
+	TacacsConfigSet(config)
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session to localhost fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author to localhost fail:%s", err.Error())
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	var dials []string
+	config := s.config()
+	config.ServerIP = "tacacs.invalid"
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials = append(dials, network+" "+addr)
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("dial context without the dial timeout")
+		}
+
+		//hand the server the other end of an in-memory connection
+		client, server := net.Pipe()
+		s.accept(server)
+		return client, nil
+	}
+	TacacsConfigSet(config)
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session through DialFunc fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author over a pipe fail:%s", err.Error())
+	}
+	sess.Close()
+
+	expect := "tcp4 " + net.JoinHostPort("tacacs.invalid", strconv.Itoa(int(s.port())))
+	if len(dials) != 1 || dials[0] != expect {
+		t.Errorf("dials %q, expect [%q]", dials, expect)
+	}
+}
@@ -0,0 +1,182 @@
+// login.go
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginRequest describes a user logging in to a shell
+type LoginRequest struct {
+	User     string
+	Password Secret
+
+	//AuthenTypeASCII (the default), AuthenTypePAP or any type with a registered strategy
+	AuthenType uint8
+	//reply timeout of every exchange in seconds, zero waits forever
+	Timeout int
+	//authorization arguments sent along with service=shell
+	Args []string
+
+	//Accounting sends a START record after authorization and a STOP record on
+	//Logout, AcctArgs are added to both
+	Accounting bool
+	AcctArgs   []string
+}
+
+// LoginSession is a user logged in by Login
+type LoginSession struct {
+	User    string
+	PrivLvl uint8
+	//authorized attribute-value pairs, the request's merged with the server's
+	Args []string
+
+	//the server's replies, for the messages to show the user
+	Authen *Result
+	Author *Result
+
+	req     LoginRequest
+	taskID  string
+	start   time.Time
+	logout  sync.Once
+	acctErr error
+}
+
+// Login authenticates req.User, authorizes service=shell and, when asked for,
+// records the start of the shell. Each step runs in a session of its own, ctx
+// bounds all of them.
+func Login(ctx context.Context, req LoginRequest) (*LoginSession, error) {
+	if TacacsMng == nil {
+		return nil, errors.New("tacacs not init")
+	}
+	authenType := req.AuthenType
+	if authenType == AuthenTypeNotSet {
+		authenType = AuthenTypeASCII
+	}
+
+	sess, err := NewSession(ctx, req.Timeout, req.User, string(req.Password))
+	if err != nil {
+		return nil, err
+	}
+	err = authenticate(sess, authenType)
+	authenResult := sess.lastResult()
+	sess.Close()
+	if err != nil {
+		fmt.Printf("login %s, authen fail:%s\n", req.User, err.Error())
+		return nil, withServerMsg(err, authenResult)
+	}
+
+	sess, err = NewSession(ctx, req.Timeout, req.User, "")
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"service=shell"}, req.Args...)
+	reply, err := author(sess, AuthenMethodTACACSPLUS, TacacsPrivLvlUser, authenType, AuthenServiceLogin, args...)
+	authorResult := sess.lastResult()
+	sess.Close()
+	if err != nil {
+		fmt.Printf("login %s, author fail:%s\n", req.User, err.Error())
+		return nil, withServerMsg(err, authorResult)
+	}
+
+	l := &LoginSession{User: req.User, req: req, Authen: authenResult, Author: authorResult}
+	l.Args = authorizedArgs(args, reply)
+	l.PrivLvl = privLvl(l.Args)
+
+	if req.Accounting {
+		id, err := CryptoSessionID()
+		if err != nil {
+			return nil, err
+		}
+		l.taskID = strconv.FormatUint(uint64(id), 10)
+		l.start = time.Now()
+		err = l.account(ctx, AcctFlagStart, "start_time="+strconv.FormatInt(l.start.Unix(), 10))
+		if err != nil {
+			fmt.Printf("login %s, accounting start fail:%s\n", req.User, err.Error())
+			return nil, err
+		}
+	}
+
+	fmt.Printf("login %s success, priv-lvl %d\n", req.User, l.PrivLvl)
+	return l, nil
+}
+
+// Logout records the end of the shell when accounting is on, only the first
+// call sends the STOP record
+func (l *LoginSession) Logout() error {
+	l.logout.Do(func() {
+		if !l.req.Accounting {
+			return
+		}
+		stop := time.Now()
+		l.acctErr = l.account(context.Background(), AcctFlagStop,
+			"stop_time="+strconv.FormatInt(stop.Unix(), 10),
+			"elapsed_time="+strconv.FormatInt(int64(stop.Sub(l.start)/time.Second), 10))
+	})
+	return l.acctErr
+}
+
+func (l *LoginSession) account(ctx context.Context, flags uint8, args ...string) error {
+	sess, err := NewSession(ctx, l.req.Timeout, l.User, "")
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	authenType := l.req.AuthenType
+	if authenType == AuthenTypeNotSet {
+		authenType = AuthenTypeASCII
+	}
+	cfg := AccountConfig{
+		Flags:         flags,
+		AuthenMethod:  AuthenMethodTACACSPLUS,
+		PrivLvl:       l.PrivLvl,
+		AuthenType:    authenType,
+		AuthenService: AuthenServiceLogin,
+	}
+	attrs := []string{"task_id=" + l.taskID, "service=shell", "priv-lvl=" + strconv.Itoa(int(l.PrivLvl))}
+	attrs = append(attrs, args...)
+	attrs = append(attrs, l.req.AcctArgs...)
+	return account(sess, cfg, attrs...)
+}
+
+// withServerMsg adds the reason the server gave for a refusal to err
+func withServerMsg(err error, r *Result) error {
+	if r == nil || r.ServerMsg == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, r.ServerMsg)
+}
+
+// authorizedArgs applies a passing reply to the requested arguments, PASS_ADD
+// adds the server's arguments and PASS_REPL replaces them
+func authorizedArgs(args []string, reply *AuthorReply) []string {
+	if reply.Status == AuthorStatusPassREPL {
+		return append([]string(nil), reply.Args...)
+	}
+	return append(append([]string(nil), args...), reply.Args...)
+}
+
+// privLvl returns the last priv-lvl attribute of args, mandatory (=) or
+// optional (*), TacacsPrivLvlUser when there is none
+func privLvl(args []string) uint8 {
+	lvl := TacacsPrivLvlUser
+	for _, arg := range args {
+		i := strings.IndexAny(arg, "=*")
+		if i < 0 || arg[:i] != "priv-lvl" {
+			continue
+		}
+		n, err := strconv.ParseUint(arg[i+1:], 10, 8)
+		if err != nil || uint8(n) > PrivLvlMax {
+			fmt.Printf("ignore invalid %s\n", arg)
+			continue
+		}
+		lvl = uint8(n)
+	}
+	return lvl
+}
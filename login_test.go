@@ -0,0 +1,109 @@
+// login_test
+package tacacs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// acctArgs returns the flags and arguments of an accounting request body
+func acctArgs(body []byte) (uint8, []string) {
+	cnt := int(body[8])
+	offset := 9 + cnt + int(body[5]) + int(body[6]) + int(body[7])
+	var args []string
+	for i := 0; i < cnt; i++ {
+		l := int(body[9+i])
+		args = append(args, string(body[offset:offset+l]))
+		offset += l
+	}
+	return body[0], args
+}
+
+func TestLogin(t *testing.T) {
+	var mu sync.Mutex
+	var records [][]string
+	var flags []uint8
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, "", "priv-lvl=15", "idletime=5"))
+		case TypeAcct:
+			f, args := acctArgs(body)
+			mu.Lock()
+			flags = append(flags, f)
+			records = append(records, args)
+			mu.Unlock()
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}
+	})
+	fakeInit(t, s)
+
+	l, err := Login(context.Background(), LoginRequest{User: "alice", Password: "secret", AuthenType: AuthenTypePAP, Timeout: 5, Accounting: true})
+	if err != nil {
+		t.Fatalf("login fail:%s", err.Error())
+	}
+	if l.PrivLvl != 15 {
+		t.Errorf("priv-lvl %d, expect 15", l.PrivLvl)
+	}
+	if strings.Join(l.Args, ",") != "service=shell,priv-lvl=15,idletime=5" {
+		t.Errorf("authorized args %q", l.Args)
+	}
+
+	if err := l.Logout(); err != nil {
+		t.Fatalf("logout fail:%s", err.Error())
+	}
+	l.Logout()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 2 || flags[0] != AcctFlagStart || flags[1] != AcctFlagStop {
+		t.Fatalf("accounting records %q flags %v, expect START then STOP", records, flags)
+	}
+	if records[0][0] != records[1][0] || !strings.HasPrefix(records[0][0], "task_id=") {
+		t.Errorf("START and STOP task ids differ:%q %q", records[0][0], records[1][0])
+	}
+	if InFlight := TacacsPoolStats()[0].InFlight; InFlight != 0 {
+		t.Errorf("%d sessions left in flight", InFlight)
+	}
+}
+
+func TestLoginDenied(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusFail, "shell not allowed"))
+		case TypeAcct:
+			t.Errorf("accounting sent for a denied login")
+		}
+	})
+	fakeInit(t, s)
+
+	_, err := Login(context.Background(), LoginRequest{User: "alice", Password: "secret", Timeout: 5, Accounting: true})
+	if err == nil {
+		t.Fatalf("login passed a failed authorization")
+	}
+}
+
+func TestPrivLvl(t *testing.T) {
+	for expect, args := range map[uint8][]string{
+		TacacsPrivLvlUser: {"service=shell"},
+		7:                 {"priv-lvl*7"},
+		15:                {"priv-lvl=3", "priv-lvl=15"},
+		3:                 {"priv-lvl=3", "priv-lvl=99", "priv-lvlx=9"},
+	} {
+		if lvl := privLvl(args); lvl != expect {
+			t.Errorf("priv-lvl of %q:%d, expect %d", args, lvl, expect)
+		}
+	}
+
+	repl := &AuthorReply{Status: AuthorStatusPassREPL, Args: []string{"priv-lvl=1"}}
+	if args := authorizedArgs([]string{"service=shell", "priv-lvl=15"}, repl); strings.Join(args, ",") != "priv-lvl=1" {
+		t.Errorf("PASS_REPL args %q", args)
+	}
+}
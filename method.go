@@ -0,0 +1,260 @@
+// method.go
+package tacacs
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHashIterations is the PBKDF2 work factor of HashPassword
+const DefaultHashIterations = 600000
+
+const (
+	localHashScheme = "pbkdf2-sha256"
+	localSaltLen    = 16
+	localHashLen    = 32
+)
+
+// ErrLocalAuthen is returned when a local account doesn't exist or the
+// password doesn't match, the two aren't told apart
+var ErrLocalAuthen = errors.New("local authentication fail")
+
+// HashPassword returns a salted hash of password for LocalStore.Add, in the
+// form $pbkdf2-sha256$iterations$salt$hash
+func HashPassword(password string) (string, error) {
+	return hashPassword(password, DefaultHashIterations)
+}
+
+func hashPassword(password string, iter int) (string, error) {
+	salt := make([]byte, localSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum, err := pbkdf2.Key(sha256.New, password, salt, iter, localHashLen)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return "$" + localHashScheme + "$" + strconv.Itoa(iter) + "$" + enc.EncodeToString(salt) + "$" +
+		enc.EncodeToString(sum), nil
+}
+
+// localUser is an account of a LocalStore
+type localUser struct {
+	iter    int
+	salt    []byte
+	hash    []byte
+	privLvl uint8
+}
+
+func parseHash(hash string) (*localUser, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) != 5 || fields[0] != "" || fields[1] != localHashScheme {
+		return nil, errors.New("unsupported password hash, use HashPassword")
+	}
+	iter, err := strconv.Atoi(fields[2])
+	if err != nil || iter < 1 {
+		return nil, errors.New("invalid password hash iterations")
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(fields[3])
+	if err != nil || len(salt) == 0 {
+		return nil, errors.New("invalid password hash salt")
+	}
+	sum, err := enc.DecodeString(fields[4])
+	if err != nil || len(sum) == 0 {
+		return nil, errors.New("invalid password hash")
+	}
+	return &localUser{iter: iter, salt: salt, hash: sum}, nil
+}
+
+func (u *localUser) match(password string) bool {
+	sum, err := pbkdf2.Key(sha256.New, password, u.salt, u.iter, len(u.hash))
+	return err == nil && subtle.ConstantTimeCompare(sum, u.hash) == 1
+}
+
+// LocalStore holds the break-glass accounts of a MethodList, only salted
+// password hashes are kept
+type LocalStore struct {
+	sync.RWMutex
+	users map[string]*localUser
+}
+
+func NewLocalStore() *LocalStore {
+	return &LocalStore{users: make(map[string]*localUser)}
+}
+
+// Add stores name with a hash made by HashPassword, replacing any account of
+// the same name
+func (s *LocalStore) Add(name, hash string, privLvl uint8) error {
+	if name == "" {
+		return errors.New("empty local user name")
+	}
+	if privLvl > PrivLvlMax {
+		return fmt.Errorf("priv-lvl %d out of range", privLvl)
+	}
+	u, err := parseHash(hash)
+	if err != nil {
+		return err
+	}
+	u.privLvl = privLvl
+	s.Lock()
+	s.users[name] = u
+	s.Unlock()
+	return nil
+}
+
+// Remove deletes the account of name
+func (s *LocalStore) Remove(name string) {
+	s.Lock()
+	delete(s.users, name)
+	s.Unlock()
+}
+
+// Authenticate checks password against the account of name and returns its
+// privilege level. The password stays a string like everywhere else in the
+// package, crypto/pbkdf2 takes it as one, so it can't be wiped after use.
+func (s *LocalStore) Authenticate(name, password string) (uint8, error) {
+	s.RLock()
+	u, ok := s.users[name]
+	var decoy *localUser
+	if !ok {
+		for _, other := range s.users {
+			decoy = other
+			break
+		}
+	}
+	s.RUnlock()
+
+	if !ok {
+		//spend the same time as for a known user
+		if decoy != nil {
+			decoy.match(password)
+		}
+		return 0, ErrLocalAuthen
+	}
+	if !u.match(password) {
+		return 0, ErrLocalAuthen
+	}
+	return u.privLvl, nil
+}
+
+// MethodList authenticates with each method in turn, like
+// "aaa authentication login default group tacacs+ local". A method is only
+// left for the next one when it couldn't give an answer: TACACS+ when no
+// server replied, an explicit FAIL from a server is final.
+type MethodList struct {
+	//AuthenMethodTACACSPLUS and AuthenMethodLocal, in the order to try them
+	Methods []uint8
+	//the accounts of AuthenMethodLocal
+	Local *LocalStore
+
+	//AuthenTypeASCII (the default), AuthenTypePAP or any type with a registered strategy
+	AuthenType uint8
+	//reply timeout of every exchange in seconds, zero waits forever
+	Timeout int
+}
+
+// MethodResult tells which method authenticated a user
+type MethodResult struct {
+	//AuthenMethodTACACSPLUS or AuthenMethodLocal, to pass on as authen_method
+	//of the authorization and accounting requests
+	Method uint8
+	//the server's reply, nil for a local account
+	Result *Result
+	//privilege level of a local account
+	PrivLvl uint8
+}
+
+// unanswered reports whether a TACACS+ attempt failed because no server could
+// be reached: a dial, connection or timeout failure. A reply that couldn't be
+// decoded still counts as an answer, and a configuration error or an
+// unsupported authen_type must be fixed rather than bypassed.
+func unanswered(err error, result *Result) bool {
+	if err == nil || result != nil {
+		return false
+	}
+	var perr *ProtocolError
+	var cerr *ConfigError
+	if errors.Is(err, ErrBadSecret) || errors.As(err, &perr) || errors.As(err, &cerr) {
+		return false
+	}
+	if errors.Is(err, ErrTimeout) {
+		return true
+	}
+	//dial failures, and waiting too long for a pooled connection
+	var terr *TransportError
+	var nerr net.Error
+	return errors.As(err, &terr) || errors.As(err, &nerr)
+}
+
+// Authenticate runs the method list for user, the error is the one of the
+// last method tried
+func (l *MethodList) Authenticate(ctx context.Context, user, password string) (*MethodResult, error) {
+	if len(l.Methods) == 0 {
+		return nil, errors.New("empty method list")
+	}
+	var err error
+	for _, method := range l.Methods {
+		switch method {
+		case AuthenMethodTACACSPLUS:
+			var result *Result
+			result, err = l.tacacs(ctx, user, password)
+			if !unanswered(err, result) {
+				return &MethodResult{Method: method, Result: result}, err
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			fmt.Printf("no TACACS+ server answered for %s, try the next method:%s\n", user, err.Error())
+		case AuthenMethodLocal:
+			return l.local(user, password)
+		default:
+			return nil, fmt.Errorf("unsupported authen method %d", method)
+		}
+	}
+	return nil, err
+}
+
+func (l *MethodList) tacacs(ctx context.Context, user, password string) (*Result, error) {
+	authenType := l.AuthenType
+	if authenType == AuthenTypeNotSet {
+		authenType = AuthenTypeASCII
+	}
+	sess, err := NewSession(ctx, l.Timeout, user, password)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+	return sess.Authen(authenType)
+}
+
+func (l *MethodList) local(user, password string) (*MethodResult, error) {
+	if l.Local == nil {
+		return nil, errors.New("no local user store")
+	}
+	privLvl, err := l.Local.Authenticate(user, password)
+
+	ev := AuditEvent{Time: time.Now(), Kind: AuditAuthen, User: user, Server: "local", Success: err == nil}
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	if TacacsMng != nil {
+		TacacsMng.emit(ev)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &MethodResult{Method: AuthenMethodLocal, PrivLvl: privLvl}, nil
+}
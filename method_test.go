@@ -0,0 +1,164 @@
+// method_test
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	first, err := hashPassword("letmein", 1000)
+	if err != nil {
+		t.Fatalf("hash fail:%s", err.Error())
+	}
+	second, _ := hashPassword("letmein", 1000)
+	if first == second || !strings.HasPrefix(first, "$pbkdf2-sha256$1000$") || strings.Contains(first, "letmein") {
+		t.Errorf("hashes %s and %s", first, second)
+	}
+
+	s := NewLocalStore()
+	if err := s.Add("admin", first, 15); err != nil {
+		t.Fatalf("add fail:%s", err.Error())
+	}
+	for _, bad := range []string{"letmein", "$md5$1$c2FsdA$aGFzaA", "$pbkdf2-sha256$0$c2FsdA$aGFzaA", "$pbkdf2-sha256$10$$aGFzaA"} {
+		if err := s.Add("oper", bad, 1); err == nil {
+			t.Errorf("hash %q accepted", bad)
+		}
+	}
+	if err := s.Add("oper", second, 16); err == nil {
+		t.Error("priv-lvl 16 accepted")
+	}
+
+	if lvl, err := s.Authenticate("admin", "letmein"); err != nil || lvl != 15 {
+		t.Errorf("admin:%d, %v", lvl, err)
+	}
+	if _, err := s.Authenticate("admin", "letmeout"); err != ErrLocalAuthen {
+		t.Errorf("wrong password:%v", err)
+	}
+	if _, err := s.Authenticate("nobody", "letmein"); err != ErrLocalAuthen {
+		t.Errorf("unknown user:%v", err)
+	}
+	s.Remove("admin")
+	if _, err := s.Authenticate("admin", "letmein"); err != ErrLocalAuthen {
+		t.Errorf("removed user:%v", err)
+	}
+}
+
+// localMethods returns a tacacs+ then local method list with admin/letmein
+func localMethods(t *testing.T) *MethodList {
+	hash, err := hashPassword("letmein", 1000)
+	if err != nil {
+		t.Fatalf("hash fail:%s", err.Error())
+	}
+	store := NewLocalStore()
+	store.Add("admin", hash, 15)
+	return &MethodList{
+		Methods:    []uint8{AuthenMethodTACACSPLUS, AuthenMethodLocal},
+		Local:      store,
+		AuthenType: AuthenTypePAP,
+		Timeout:    1,
+	}
+}
+
+func TestMethodListFallback(t *testing.T) {
+	//a server that is gone
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {})
+	fakeInit(t, s)
+	s.close()
+
+	var events []AuditEvent
+	unsubscribe := TacacsMng.Subscribe(AuditFunc(func(ev AuditEvent) {
+		events = append(events, ev)
+	}))
+	defer unsubscribe()
+
+	l := localMethods(t)
+	r, err := l.Authenticate(context.Background(), "admin", "letmein")
+	if err != nil {
+		t.Fatalf("fallback fail:%s", err.Error())
+	}
+	if r.Method != AuthenMethodLocal || r.PrivLvl != 15 || r.Result != nil {
+		t.Errorf("result %+v", r)
+	}
+	if _, err := l.Authenticate(context.Background(), "admin", "wrong"); err != ErrLocalAuthen {
+		t.Errorf("wrong local password:%v", err)
+	}
+	if len(events) != 2 || events[0].Server != "local" || !events[0].Success || events[1].Success {
+		t.Errorf("audit events %+v", events)
+	}
+
+	l.Methods = []uint8{AuthenMethodTACACSPLUS}
+	if _, err := l.Authenticate(context.Background(), "admin", "letmein"); err == nil || err == ErrLocalAuthen {
+		t.Errorf("tacacs+ only:%v", err)
+	}
+}
+
+func TestMethodListTimeout(t *testing.T) {
+	//a server that never answers
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {})
+	fakeInit(t, s)
+
+	r, err := localMethods(t).Authenticate(context.Background(), "admin", "letmein")
+	if err != nil || r.Method != AuthenMethodLocal {
+		t.Fatalf("fallback after timeout:%+v, %v", r, err)
+	}
+}
+
+func TestMethodListNoFallback(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authenReplyBody(AuthenStatusFail, "locked out", ""))
+	})
+	fakeInit(t, s)
+
+	r, err := localMethods(t).Authenticate(context.Background(), "admin", "letmein")
+	if err == nil || errors.Is(err, ErrLocalAuthen) {
+		t.Fatalf("explicit FAIL fell back:%v", err)
+	}
+	if r == nil || r.Method != AuthenMethodTACACSPLUS || r.Result == nil || r.Result.ServerMsg != "locked out" {
+		t.Errorf("result %+v", r)
+	}
+}
+
+func TestMethodListBadSecret(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+	})
+	s.key = "not the client key"
+	fakeInit(t, s)
+	config := s.config()
+	config.ShareKey = fakeKey
+	TacacsConfigSet(config)
+
+	//a reply that can't be decoded is still an answer
+	if _, err := localMethods(t).Authenticate(context.Background(), "admin", "letmein"); !errors.Is(err, ErrBadSecret) {
+		t.Errorf("bad secret:%v", err)
+	}
+}
+
+func TestMethodListConfigErrors(t *testing.T) {
+	//a reachable server, a mistake on our side must not open the local accounts
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authenReplyBody(AuthenStatusFail, "", ""))
+	})
+	fakeInit(t, s)
+
+	l := localMethods(t)
+	l.AuthenType = 0x42
+	if r, err := l.Authenticate(context.Background(), "admin", "letmein"); err == nil || r.Method == AuthenMethodLocal {
+		t.Errorf("unsupported authen type:%+v, %v", r, err)
+	}
+
+	for name, mangle := range map[string]func(c *TacacsConfig){
+		"IPtype":     func(c *TacacsConfig) { c.IPtype = "bogus" },
+		"BindDevice": func(c *TacacsConfig) { c.BindDevice = "nosuchdev0" },
+	} {
+		config := s.config()
+		mangle(&config)
+		TacacsConfigSet(config)
+		if r, err := localMethods(t).Authenticate(context.Background(), "admin", "letmein"); err == nil || r.Method == AuthenMethodLocal {
+			t.Errorf("bad %s:%+v, %v", name, r, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// metrics.go
+package tacacs
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// typeName labels a packet type in the metrics and traces
+func typeName(typ uint8) string {
+	switch typ {
+	case TypeAuthen:
+		return "authen"
+	case TypeAuthor:
+		return "author"
+	case TypeAcct:
+		return "acct"
+	default:
+		return strconv.Itoa(int(typ))
+	}
+}
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 //per bucket, the last one is +Inf
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// metricsSet holds the counters of every session since the process started,
+// they survive TacacsExit and configuration changes
+type metricsSet struct {
+	sync.Mutex
+	requests  map[[2]string]uint64  //by type and result
+	latency   map[string]*histogram //by server
+	timeouts  map[string]uint64     //by type
+	badSecret map[string]uint64     //by server
+	reconnect map[string]uint64     //by server
+}
+
+var tacacsMetrics = newMetricsSet()
+
+func newMetricsSet() *metricsSet {
+	return &metricsSet{
+		requests:  make(map[[2]string]uint64),
+		latency:   make(map[string]*histogram),
+		timeouts:  make(map[string]uint64),
+		badSecret: make(map[string]uint64),
+		reconnect: make(map[string]uint64),
+	}
+}
+
+func init() {
+	expvar.Publish("tacacs", expvar.Func(func() interface{} {
+		return tacacsMetrics.snapshot()
+	}))
+}
+
+// requestResult sorts the outcome of an exchange for the metrics
+func requestResult(err error, result *Result) string {
+	switch {
+	case err == nil:
+		return "pass"
+	case errors.Is(err, ErrTimeout):
+		return "timeout"
+	case errors.Is(err, ErrBadSecret):
+		return "bad_secret"
+	case result != nil:
+		//the server answered, and not with a pass
+		return "fail"
+	default:
+		return "error"
+	}
+}
+
+// observe records an exchange of packet type typ that began at start in the
+// metrics, the tracer and the audit events, it is meant to be deferred with
+// the address of the exchange's error and the arguments of the request
+func (sess *Session) observe(typ uint8, start time.Time, err *error, args ...string) {
+	server := ""
+	if sess.pool != nil {
+		server = sess.pool.server
+	}
+	result := requestResult(*err, sess.lastResult())
+	sess.traceComplete(typ, start, result, *err)
+	sess.audit(typ, *err, args)
+
+	kind := typeName(typ)
+	m := tacacsMetrics
+	m.Lock()
+	defer m.Unlock()
+	m.requests[[2]string{kind, result}]++
+	if result == "timeout" {
+		m.timeouts[kind]++
+	}
+	h := m.latency[server]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[server] = h
+	}
+	h.observe(time.Since(start).Seconds())
+}
+
+// badSecretSeen counts a reply that couldn't be deobfuscated with the key in use
+func (m *metricsSet) badSecretSeen(server string) {
+	m.Lock()
+	m.badSecret[server]++
+	m.Unlock()
+}
+
+// reconnectSeen counts a supervised connection redialed after it was lost
+func (m *metricsSet) reconnectSeen(server string) {
+	m.Lock()
+	m.reconnect[server]++
+	m.Unlock()
+}
+
+// reconnects returns the reconnect counts by server, servers of live pools
+// that never reconnected count zero, must be called with the lock held
+func (m *metricsSet) reconnects(pools []PoolStats) map[string]uint64 {
+	reconnects := make(map[string]uint64, len(m.reconnect))
+	for _, p := range pools {
+		reconnects[p.Server] = 0
+	}
+	for server, n := range m.reconnect {
+		reconnects[server] = n
+	}
+	return reconnects
+}
+
+// poolGauges reads the state of the live connection pools
+func poolGauges() (sessions int, pools []PoolStats) {
+	mng := TacacsMng
+	if mng == nil {
+		return 0, nil
+	}
+	mng.Lock()
+	for _, p := range mng.pools {
+		pools = append(pools, p.stats())
+	}
+	mng.Unlock()
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Server < pools[j].Server })
+	return mng.OpenSessions(), pools
+}
+
+// snapshot is what expvar publishes under "tacacs"
+func (m *metricsSet) snapshot() map[string]interface{} {
+	sessions, pools := poolGauges()
+
+	m.Lock()
+	defer m.Unlock()
+	requests := make(map[string]uint64)
+	for k, v := range m.requests {
+		requests[k[0]+"/"+k[1]] = v
+	}
+	latency := make(map[string]interface{})
+	for server, h := range m.latency {
+		buckets := make(map[string]uint64)
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			buckets[formatFloat(le)] = cum
+		}
+		latency[server] = map[string]interface{}{"count": h.count, "sum": h.sum, "buckets": buckets}
+	}
+	timeouts := make(map[string]uint64)
+	for k, v := range m.timeouts {
+		timeouts[k] = v
+	}
+	badSecret := make(map[string]uint64)
+	for k, v := range m.badSecret {
+		badSecret[k] = v
+	}
+	queued := make(map[string]uint64)
+	for _, p := range pools {
+		queued[p.Server] = p.Queued
+	}
+	return map[string]interface{}{
+		"requests":        requests,
+		"latency_seconds": latency,
+		"timeouts":        timeouts,
+		"bad_secret":      badSecret,
+		"reconnects":      m.reconnects(pools),
+		"active_sessions": sessions,
+		"send_queue":      queued,
+	}
+}
+
+// MetricsHandler serves the client metrics in the Prometheus text exposition
+// format, the same numbers are published through expvar as "tacacs"
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		tacacsMetrics.writeText(w)
+	})
+}
+
+func (m *metricsSet) writeText(w io.Writer) {
+	sessions, pools := poolGauges()
+
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP tacacs_requests_total TACACS+ exchanges by type and result.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_requests_total counter\n")
+	keys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "tacacs_requests_total{type=%s,result=%s} %d\n", quoteLabel(k[0]), quoteLabel(k[1]), m.requests[k])
+	}
+
+	fmt.Fprintf(w, "# HELP tacacs_request_duration_seconds TACACS+ exchange latency by server.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_request_duration_seconds histogram\n")
+	servers := make([]string, 0, len(m.latency))
+	for server := range m.latency {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		h := m.latency[server]
+		var cum uint64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "tacacs_request_duration_seconds_bucket{server=%s,le=\"%s\"} %d\n", quoteLabel(server), formatFloat(le), cum)
+		}
+		fmt.Fprintf(w, "tacacs_request_duration_seconds_bucket{server=%s,le=\"+Inf\"} %d\n", quoteLabel(server), h.count)
+		fmt.Fprintf(w, "tacacs_request_duration_seconds_sum{server=%s} %s\n", quoteLabel(server), formatFloat(h.sum))
+		fmt.Fprintf(w, "tacacs_request_duration_seconds_count{server=%s} %d\n", quoteLabel(server), h.count)
+	}
+
+	fmt.Fprintf(w, "# HELP tacacs_timeouts_total TACACS+ exchanges the server didn't answer in time.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_timeouts_total counter\n")
+	for _, kind := range sortedKeys(m.timeouts) {
+		fmt.Fprintf(w, "tacacs_timeouts_total{type=%s} %d\n", quoteLabel(kind), m.timeouts[kind])
+	}
+
+	fmt.Fprintf(w, "# HELP tacacs_bad_secret_total Replies that couldn't be deobfuscated with the shared key in use.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_bad_secret_total counter\n")
+	for _, server := range sortedKeys(m.badSecret) {
+		fmt.Fprintf(w, "tacacs_bad_secret_total{server=%s} %d\n", quoteLabel(server), m.badSecret[server])
+	}
+
+	fmt.Fprintf(w, "# HELP tacacs_reconnects_total Supervised connections redialed by server.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_reconnects_total counter\n")
+	reconnects := m.reconnects(pools)
+	for _, server := range sortedKeys(reconnects) {
+		fmt.Fprintf(w, "tacacs_reconnects_total{server=%s} %d\n", quoteLabel(server), reconnects[server])
+	}
+
+	fmt.Fprintf(w, "# HELP tacacs_active_sessions Sessions currently open.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_active_sessions gauge\n")
+	fmt.Fprintf(w, "tacacs_active_sessions %d\n", sessions)
+
+	fmt.Fprintf(w, "# HELP tacacs_send_queue_depth Packets waiting to be written by server.\n")
+	fmt.Fprintf(w, "# TYPE tacacs_send_queue_depth gauge\n")
+	for _, p := range pools {
+		fmt.Fprintf(w, "tacacs_send_queue_depth{server=%s} %d\n", quoteLabel(p.Server), p.Queued)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quoteLabel quotes a label value the way the exposition format escapes it
+func quoteLabel(v string) string {
+	v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+	return `"` + v + `"`
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
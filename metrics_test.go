@@ -0,0 +1,108 @@
+// metrics_test
+package tacacs
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrape returns the samples the metrics handler serves, keyed by name and labels
+func scrape(t *testing.T) map[string]float64 {
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad sample %q", line)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusFail, "denied"))
+		case TypeAcct:
+			//never answered
+		}
+	})
+	fakeInit(t, s)
+	server := `server="` + s.config().ServerIP + ":" + strconv.Itoa(int(s.port())) + `"`
+	before := scrape(t)
+
+	if _, err := AuthenPAP(5, "alice", "secret"); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	sess, err := NewSession(TacacsMng.ctx, 1, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	if _, err := Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell"); err == nil {
+		t.Fatal("author passed")
+	}
+	if _, err := Account(sess, AccountConfig{Flags: AcctFlagStart}, "task_id=1"); err != ErrTimeout {
+		t.Fatalf("account:%v", err)
+	}
+
+	after := scrape(t)
+	for sample, delta := range map[string]float64{
+		`tacacs_requests_total{type="authen",result="pass"}`:               1,
+		`tacacs_requests_total{type="author",result="fail"}`:               1,
+		`tacacs_requests_total{type="acct",result="timeout"}`:              1,
+		`tacacs_timeouts_total{type="acct"}`:                               1,
+		`tacacs_request_duration_seconds_count{` + server + `}`:            3,
+		`tacacs_request_duration_seconds_bucket{` + server + `,le="+Inf"}`: 3,
+	} {
+		if got := after[sample] - before[sample]; got != delta {
+			t.Errorf("%s moved by %v, expect %v", sample, got, delta)
+		}
+	}
+	if after["tacacs_active_sessions"] != 1 {
+		t.Errorf("active sessions %v", after["tacacs_active_sessions"])
+	}
+	if _, ok := after[`tacacs_send_queue_depth{`+server+`}`]; !ok {
+		t.Error("no send queue depth")
+	}
+	if _, ok := after[`tacacs_reconnects_total{`+server+`}`]; !ok {
+		t.Error("no reconnects")
+	}
+
+	var published map[string]interface{}
+	if err := json.Unmarshal([]byte(expvar.Get("tacacs").String()), &published); err != nil {
+		t.Fatalf("expvar:%s", err.Error())
+	}
+	requests, _ := published["requests"].(map[string]interface{})
+	if requests["authen/pass"] == nil || published["active_sessions"] != float64(1) {
+		t.Errorf("expvar %v", published)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	if got := quoteLabel("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("quoted %s", got)
+	}
+	h := &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+	h.observe(0.005)
+	h.observe(20)
+	if h.counts[0] != 1 || h.counts[len(latencyBuckets)] != 1 || h.count != 2 {
+		t.Errorf("buckets %v", h.counts)
+	}
+}
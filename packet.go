@@ -10,8 +10,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
 )
 
 const (
@@ -71,13 +71,17 @@ type TacacsHeader struct {
 	Length    uint32
 }
 
-func (h *TacacsHeader) unmarshal(data []byte) {
+func (h *TacacsHeader) unmarshal(data []byte) error {
+	if len(data) < HeaderLen {
+		return errors.New("packet shorter than header")
+	}
 	h.Version = uint8(data[VersionOffset])
 	h.Type = uint8(data[TypeOffset])
 	h.SeqNo = uint8(data[SeqNoOffset])
 	h.Flags = uint8(data[FlagsOffset])
 	h.SessionID = binary.BigEndian.Uint32(data[SessionIDOffset:])
 	h.Length = binary.BigEndian.Uint32(data[LengthOffset:])
+	return nil
 }
 
 func (h *TacacsHeader) marshal() []byte {
@@ -159,40 +163,34 @@ type AuthenStart struct {
 	User       string
 	Port       string
 	RmtAddr    string
-	Data       string
+	Data       []byte
 }
 
 func GetPort(addr string) (uint16, error) {
 	if len(addr) == 0 {
 		return 0, errors.New("invalid addr")
-	} else {
-		offset := strings.LastIndex(addr, ":")
-		if offset == -1 {
-			return 0, errors.New("invalid addr, no port found")
-		} else {
-			data := addr[(offset + 1):]
-			port, err := strconv.ParseUint(string(data), 10, 16)
-			if err != nil {
-				return 0, err
-			} else {
-				return uint16(port), nil
-			}
-		}
 	}
+	_, data, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.ParseUint(data, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(port), nil
 }
 
+// GetIP returns the host of addr, an IPv6 address comes without brackets
 func GetIP(addr string) (string, error) {
 	if len(addr) == 0 {
 		return "", errors.New("invalid addr")
-	} else {
-		offset := strings.LastIndex(addr, ":")
-		if offset == -1 {
-			return "", errors.New("invalid addr, no port found")
-		} else {
-			data := addr[:offset]
-			return string(data), nil
-		}
 	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return host, nil
 }
 
 func (a *AuthenStart) marshal() ([]byte, error) {
@@ -256,6 +254,13 @@ type AuthenReplyPacket struct {
 }
 
 func (a *AuthenReplyPacket) unmarshal(data []byte) error {
+	if len(data) != int(a.Header.Length) {
+		return fmt.Errorf("authen reply body %d bytes, header length %d", len(data), a.Header.Length)
+	}
+	if len(data) < 6 {
+		return errors.New("authen reply too short")
+	}
+
 	a.Status = uint8(data[0])
 
 	a.Flags = uint8(data[1])
@@ -266,16 +271,22 @@ func (a *AuthenReplyPacket) unmarshal(data []byte) error {
 	//fmt.Printf("ServerMsg len :%d,DataLen:%d\n", a.ServerMsgLen, a.DataLen)
 	a.DataLen = binary.BigEndian.Uint16(data[4:])
 
-	if a.ServerMsgLen != 0 {
-		a.ServerMsg = string(data[6:(a.ServerMsgLen + 6)])
-		//fmt.Println("server msg: " + string(a.ServerMsg))
+	//the lengths are obfuscated too, with a wrong key they won't add up
+	msgEnd := 6 + int(a.ServerMsgLen)
+	dataEnd := msgEnd + int(a.DataLen)
+	if dataEnd != len(data) {
+		return fmt.Errorf("%w, authen reply fields need %d bytes, body has %d", ErrBadSecret, dataEnd, len(data))
 	}
-
-	if a.DataLen != 0 {
-		a.Data = string(data[(a.ServerMsgLen + 6):])
-		//fmt.Println("data msg : " + string(a.Data))
+	switch a.Status {
+	case AuthenStatusPass, AuthenStatusFail, AuthenStatusGetData, AuthenStatusGetUser,
+		AuthenStatusGetPass, AuthenStatusRestart, AuthenStatusError, AuthenStatusFollow:
+	default:
+		return fmt.Errorf("%w, unknown authen status %d", ErrBadSecret, a.Status)
 	}
 
+	a.ServerMsg = string(data[6:msgEnd])
+	a.Data = string(data[msgEnd:dataEnd])
+
 	return nil
 }
 
@@ -284,36 +295,15 @@ func (a *AuthenReplyPacket) marshal() {
 }
 
 func (a *AuthenReplyPacket) varify(s *Session) error {
-	//check version
-	//if a.Header.Version != (MajorVersion | MinorVersionDefault) {
-	//	fmt.Printf("version:%d, expect:%d\n", a.Header.Version, (MajorVersion | MinorVersionDefault))
-	//	return errors.New("version mismatch")
-	//}
-
-	//check flag
-	if a.Header.Flags == 1 {
-		s.mng.Lock()
-		if !s.mng.ServerConnMultiplexing {
-			s.mng.ServerConnMultiplexing = true
-			fmt.Println("server support ConnMultiplexing")
-		}
-		s.mng.Unlock()
+	if err := s.checkReply(&a.Header); err != nil {
+		return err
 	}
 
-	//check seqNo
-	s.Lock()
-	if a.Header.SeqNo == s.SessionSeqNo {
-		if s.SessionSeqNo == 255 {
-			s.restart = true
-			s.Unlock()
-			return errors.New("session seqNo overflow,restart")
-		} else {
-			s.SessionSeqNo++
-		}
+	//check flag
+	if (a.Header.Flags & SingleConnectFlag) != 0 {
+		s.pool.setSingleConnect()
 	}
-	s.Unlock()
 
-	//check sessionID
 	return nil
 }
 
@@ -334,30 +324,28 @@ type AuthenContinuePacket struct {
 	UserMsgLen uint16
 	DataLen    uint16
 	Flags      uint8
-	Data       string
-	UserMsg    string
+	Data       []byte
+	UserMsg    []byte
 }
 
-//版本应该根据认证类型来确定TODO
-func (p *AuthenContinuePacket) init(s *Session) {
+// version is the one of the START packet
+func (p *AuthenContinuePacket) init(s *Session, version uint8, userMsg, data []byte) {
 	s.Lock()
 	defer s.Unlock()
-	p.Header.Version = (MajorVersion | MinorVersionDefault)
+	p.Header.Version = version
 	p.Header.Type = TypeAuthen
-	p.Header.SeqNo = s.SessionSeqNo
-	s.SessionSeqNo++
-	s.mng.Lock()
-	if s.mng.Config.ConnMultiplexing {
+	p.Header.SeqNo = s.nextSeqNo(p.Header.Version, p.Header.Type)
+	if s.pool.config.ConnMultiplexing {
 		p.Header.Flags |= SingleConnectFlag
 	}
-	s.mng.Unlock()
 
 	p.Header.SessionID = s.SessionID
-	p.DataLen = 0
-	p.Header.Length = uint32(5 + len(s.Password))
+	p.DataLen = uint16(len(data))
+	p.Data = data
+	p.Header.Length = uint32(5 + len(userMsg) + len(data))
 	fmt.Printf("continue packet len:%d\n", p.Header.Length)
-	p.UserMsgLen = uint16(len(s.Password))
-	p.UserMsg = s.Password
+	p.UserMsgLen = uint16(len(userMsg))
+	p.UserMsg = userMsg
 }
 
 func (p *AuthenContinuePacket) marshal() ([]byte, error) {
@@ -381,6 +369,23 @@ func (p *AuthenContinuePacket) unmarshal() {
 
 }
 
+// ErrBadSecret is returned when a reply doesn't look like anything a server
+// sends once deobfuscated, almost always because the shared key is wrong
+var ErrBadSecret = errors.New("bad secret, reply can't be deobfuscated")
+
+// ErrTimeout is returned when the server doesn't reply within the session timeout
+var ErrTimeout = errors.New("timeout")
+
+// ProtocolError reports a reply that breaks the sequencing rules of the draft,
+// the session is ended and its connection reset
+type ProtocolError struct {
+	Reason string
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error, " + e.Reason
+}
+
 //
 //	CP4.7. Data Obfuscation
 //
@@ -547,59 +552,70 @@ type AuthorReply struct {
 	ArgCnt       uint8
 	ServerMsgLen uint16
 	DataLen      uint16
-	//Arg1Len
-	//Arg2Len
-	//...
-	//ArgNLen
-	//ServerMsg
-	//Data
-	//Arg1
-	//Arg2
-	//...
-	//ArgN
+	ServerMsg    string
+	Data         string
+	Args         []string
 }
 
-func (p *AuthorReply) unmarshal(data []byte) {
-	(&p.Header).unmarshal(data)
-	p.Status = uint8(data[0+HeaderLen])
-	p.ArgCnt = uint8(data[1+HeaderLen])
-	p.ServerMsgLen = binary.BigEndian.Uint16(data[(2 + HeaderLen):])
-	p.DataLen = binary.BigEndian.Uint16(data[(4 + HeaderLen):])
-}
+func (p *AuthorReply) unmarshal(data []byte) error {
+	if err := (&p.Header).unmarshal(data); err != nil {
+		return err
+	}
+	body := data[HeaderLen:]
+	if len(body) != int(p.Header.Length) {
+		return fmt.Errorf("author reply body %d bytes, header length %d", len(body), p.Header.Length)
+	}
+	if len(body) < 6 {
+		return errors.New("author reply too short")
+	}
 
-func (p *AuthorReply) SanityCheck(sess *Session, data []byte) error {
-	if p.Header.Version != (MajorVersion | MinorVersionDefault) {
-		return errors.New("invalid version, author reply check fail")
+	p.Status = uint8(body[0])
+	p.ArgCnt = uint8(body[1])
+	p.ServerMsgLen = binary.BigEndian.Uint16(body[2:])
+	p.DataLen = binary.BigEndian.Uint16(body[4:])
+
+	//the lengths are obfuscated too, with a wrong key they won't add up
+	offset := 6 + int(p.ArgCnt)
+	if offset > len(body) {
+		return fmt.Errorf("%w, author reply %d arg lengths don't fit the body", ErrBadSecret, p.ArgCnt)
 	}
+	argLens := body[6:offset]
 
-	//check Single Connect Flag
-	if (p.Header.Flags & SingleConnectFlag) == 1 {
-		sess.mng.Lock()
-		if !sess.mng.ServerConnMultiplexing {
-			sess.mng.ServerConnMultiplexing = true
-			fmt.Println("server support ConnMultiplexing")
-		}
-		sess.mng.Unlock()
+	end := offset + int(p.ServerMsgLen) + int(p.DataLen)
+	for _, l := range argLens {
+		end += int(l)
+	}
+	if end != len(body) {
+		return fmt.Errorf("%w, author reply fields need %d bytes, body has %d", ErrBadSecret, end, len(body))
+	}
+	switch p.Status {
+	case AuthorStatusPassAdd, AuthorStatusPassREPL, AuthorStatusFail, AuthorStatusError, AuthorStatusFollow:
+	default:
+		return fmt.Errorf("%w, unknown author status %d", ErrBadSecret, p.Status)
 	}
 
-	//check unencrypted flag, only set when debug
-	if (p.Header.Flags & UnencryptedFlag) == 1 {
-		fmt.Printf("Warning! unencrypted packet,not support\n")
-		return errors.New("Warning! unencrypted packet,not support")
+	p.ServerMsg = string(body[offset:(offset + int(p.ServerMsgLen))])
+	offset += int(p.ServerMsgLen)
+	p.Data = string(body[offset:(offset + int(p.DataLen))])
+	offset += int(p.DataLen)
+
+	p.Args = make([]string, 0, p.ArgCnt)
+	for _, l := range argLens {
+		p.Args = append(p.Args, string(body[offset:(offset+int(l))]))
+		offset += int(l)
 	}
+	return nil
+}
 
-	//check seqNo
-	sess.Lock()
-	if p.Header.SeqNo == sess.SessionSeqNo {
-		if sess.SessionSeqNo == 255 {
-			sess.restart = true
-			sess.Unlock()
-			return errors.New("session seqNo overflow,restart")
-		} else {
-			sess.SessionSeqNo++
-		}
+func (p *AuthorReply) SanityCheck(sess *Session, data []byte) error {
+	if err := sess.checkReply(&p.Header); err != nil {
+		return err
+	}
+
+	//check Single Connect Flag
+	if (p.Header.Flags & SingleConnectFlag) != 0 {
+		sess.pool.setSingleConnect()
 	}
-	sess.Unlock()
 
 	if len(data) != int(p.Header.Length+HeaderLen) {
 		fmt.Printf("invalid author response,recv:%d, hdr->len:%d\n", len(data), int(p.Header.Length+HeaderLen))
@@ -704,56 +720,48 @@ func (p *AccountReply) marshal() {
 	//TODO
 }
 
-func (p *AccountReply) unmarshal(data []byte) {
-	(&p.Header).unmarshal(data)
-	p.ServerMsgLen = binary.BigEndian.Uint16(data[HeaderLen:])
-	p.DataLen = binary.BigEndian.Uint16(data[(2 + HeaderLen):])
-	p.Status = uint8(data[4+HeaderLen])
-
-	if p.ServerMsgLen != 0 {
-		p.ServerMsg = string(data[(HeaderLen + 5):(p.ServerMsgLen + HeaderLen + 5)])
-		//fmt.Println("server msg: " + string(a.ServerMsg))
+func (p *AccountReply) unmarshal(data []byte) error {
+	if err := (&p.Header).unmarshal(data); err != nil {
+		return err
+	}
+	body := data[HeaderLen:]
+	if len(body) != int(p.Header.Length) {
+		return fmt.Errorf("account reply body %d bytes, header length %d", len(body), p.Header.Length)
+	}
+	if len(body) < 5 {
+		return errors.New("account reply too short")
 	}
 
-	if p.DataLen != 0 {
-		p.Data = string(data[(p.ServerMsgLen + 5 + HeaderLen):])
-		//fmt.Println("data msg : " + string(a.Data))
+	p.ServerMsgLen = binary.BigEndian.Uint16(body)
+	p.DataLen = binary.BigEndian.Uint16(body[2:])
+	p.Status = uint8(body[4])
+
+	//the lengths are obfuscated too, with a wrong key they won't add up
+	msgEnd := 5 + int(p.ServerMsgLen)
+	dataEnd := msgEnd + int(p.DataLen)
+	if dataEnd != len(body) {
+		return fmt.Errorf("%w, account reply fields need %d bytes, body has %d", ErrBadSecret, dataEnd, len(body))
+	}
+	switch p.Status {
+	case AccountStatusSuccess, AccountStatusError, AccountStatusFollow:
+	default:
+		return fmt.Errorf("%w, unknown account status %d", ErrBadSecret, p.Status)
 	}
+
+	p.ServerMsg = string(body[5:msgEnd])
+	p.Data = string(body[msgEnd:dataEnd])
+	return nil
 }
 
 func (p *AccountReply) SanityCheck(sess *Session, data []byte) error {
-	if p.Header.Version != (MajorVersion | MinorVersionDefault) {
-		return errors.New("invalid version, author reply check fail")
+	if err := sess.checkReply(&p.Header); err != nil {
+		return err
 	}
 
 	//check Single Connect Flag
-	if (p.Header.Flags & SingleConnectFlag) == 1 {
-		sess.mng.Lock()
-		if !sess.mng.ServerConnMultiplexing {
-			sess.mng.ServerConnMultiplexing = true
-			fmt.Println("server support ConnMultiplexing")
-		}
-		sess.mng.Unlock()
-	}
-
-	//check unencrypted flag, only set when debug
-	if (p.Header.Flags & UnencryptedFlag) == 1 {
-		fmt.Printf("Warning! unencrypted packet,not support\n")
-		return errors.New("Warning! unencrypted packet,not support")
-	}
-
-	//check seqNo
-	sess.Lock()
-	if p.Header.SeqNo == sess.SessionSeqNo {
-		if sess.SessionSeqNo == 255 {
-			sess.restart = true
-			sess.Unlock()
-			return errors.New("session seqNo overflow,restart")
-		} else {
-			sess.SessionSeqNo++
-		}
+	if (p.Header.Flags & SingleConnectFlag) != 0 {
+		sess.pool.setSingleConnect()
 	}
-	sess.Unlock()
 
 	if len(data) != int(p.Header.Length+HeaderLen) {
 		fmt.Printf("invalid author response,recv:%d, hdr->len:%d\n", len(data), int(p.Header.Length+HeaderLen))
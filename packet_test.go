@@ -0,0 +1,170 @@
+// packet_test
+package tacacs
+
+import (
+	"errors"
+	"testing"
+)
+
+// packet builds a reply of tacacsType around body
+func packet(tacacsType uint8, body []byte) []byte {
+	hdr := TacacsHeader{}
+	hdr.Version = MajorVersion | MinorVersionDefault
+	hdr.Type = tacacsType
+	hdr.SeqNo = 2
+	hdr.Length = uint32(len(body))
+	return append(hdr.marshal(), body...)
+}
+
+func TestGetIPPort(t *testing.T) {
+	for addr, expect := range map[string]string{
+		"10.0.0.1:49":           "10.0.0.1",
+		"[2001:db8::1]:49":      "2001:db8::1",
+		"[fe80::1%eth0]:49":     "fe80::1%eth0",
+		"tacacs.example.com:49": "tacacs.example.com",
+	} {
+		ip, err := GetIP(addr)
+		if err != nil || ip != expect {
+			t.Errorf("GetIP(%q):%q (%v), expect %q", addr, ip, err, expect)
+		}
+		port, err := GetPort(addr)
+		if err != nil || port != 49 {
+			t.Errorf("GetPort(%q):%d (%v), expect 49", addr, port, err)
+		}
+	}
+
+	for _, addr := range []string{"", "10.0.0.1", "2001:db8::1", "10.0.0.1:port"} {
+		if _, err := GetPort(addr); err == nil {
+			t.Errorf("GetPort(%q) accepted", addr)
+		}
+	}
+}
+
+func TestAuthorReplyArgs(t *testing.T) {
+	p := &AuthorReply{}
+	data := packet(TypeAuthor, authorReplyBody(AuthorStatusPassAdd, "welcome", "priv-lvl=15", "timeout=60"))
+	if err := p.unmarshal(data); err != nil {
+		t.Fatalf("decode fail:%s", err.Error())
+	}
+	if p.ServerMsg != "welcome" || len(p.Args) != 2 || p.Args[0] != "priv-lvl=15" || p.Args[1] != "timeout=60" {
+		t.Errorf("unexpected decode:%+v", p)
+	}
+}
+
+func TestDecodersRejectShortBodies(t *testing.T) {
+	author := authorReplyBody(AuthorStatusPassAdd, "msg", "service=shell")
+	if err := (&AuthorReply{}).unmarshal(packet(TypeAuthor, author[:len(author)-1])); err == nil {
+		t.Errorf("truncated author reply accepted")
+	}
+
+	acct := acctReplyBody(AccountStatusSuccess, "msg")
+	if err := (&AccountReply{}).unmarshal(packet(TypeAcct, acct[:len(acct)-1])); err == nil {
+		t.Errorf("truncated account reply accepted")
+	}
+
+	authen := authenReplyBody(AuthenStatusPass, "msg", "data")
+	reply := &AuthenReplyPacket{}
+	reply.Header.Length = uint32(len(authen) - 1)
+	if err := reply.unmarshal(authen[:len(authen)-1]); err == nil {
+		t.Errorf("truncated authen reply accepted")
+	}
+}
+
+func TestBadSecret(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, "", "priv-lvl=15"))
+		case TypeAcct:
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}
+	})
+	s.key = "not the client key"
+	fakeInit(t, s)
+	config := s.config()
+	config.ShareKey = fakeKey
+	TacacsConfigSet(config)
+
+	//fixed session ids keep the garbage, and so the test, reproducible
+	id := uint32(0x1000)
+	TacacsMng.SessionIDGen = func() (uint32, error) {
+		id++
+		return id, nil
+	}
+	defer func() { TacacsMng.SessionIDGen = nil }()
+
+	if _, err := AuthenPAP(5, "alice", "secret"); !errors.Is(err, ErrBadSecret) {
+		t.Errorf("authen with a wrong key:%v", err)
+	}
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if !errors.Is(err, ErrBadSecret) {
+		t.Errorf("author with a wrong key:%v", err)
+	}
+
+	sess, err = NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Account(sess, AccountConfig{Flags: AcctFlagStart}, "task_id=1")
+	if !errors.Is(err, ErrBadSecret) {
+		t.Errorf("account with a wrong key:%v", err)
+	}
+}
+
+func FuzzAuthenReply(f *testing.F) {
+	f.Add(authenReplyBody(AuthenStatusPass, "", ""), uint32(6))
+	f.Add(authenReplyBody(AuthenStatusGetPass, "Password: ", "x"), uint32(17))
+	f.Add([]byte{1, 0, 0xff, 0xff, 0, 0}, uint32(6))
+
+	f.Fuzz(func(t *testing.T, body []byte, length uint32) {
+		reply := &AuthenReplyPacket{}
+		reply.Header.Length = length
+		if err := reply.unmarshal(body); err != nil {
+			return
+		}
+		if len(reply.ServerMsg) != int(reply.ServerMsgLen) || len(reply.Data) != int(reply.DataLen) {
+			t.Fatalf("decoded fields don't match their lengths:%+v", reply)
+		}
+	})
+}
+
+func FuzzAuthorReply(f *testing.F) {
+	f.Add(packet(TypeAuthor, authorReplyBody(AuthorStatusPassAdd, "", "priv-lvl=15")))
+	f.Add(packet(TypeAuthor, authorReplyBody(AuthorStatusFail, "denied")))
+	f.Add(packet(TypeAuthor, []byte{1, 255, 0, 0, 0, 0}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &AuthorReply{}
+		if err := p.unmarshal(data); err != nil {
+			return
+		}
+		if len(p.Args) != int(p.ArgCnt) || len(p.ServerMsg) != int(p.ServerMsgLen) || len(p.Data) != int(p.DataLen) {
+			t.Fatalf("decoded fields don't match their lengths:%+v", p)
+		}
+	})
+}
+
+func FuzzAccountReply(f *testing.F) {
+	f.Add(packet(TypeAcct, acctReplyBody(AccountStatusSuccess, "")))
+	f.Add(packet(TypeAcct, acctReplyBody(AccountStatusError, "disk full")))
+	f.Add(packet(TypeAcct, []byte{0xff, 0xff, 0, 0, 1}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &AccountReply{}
+		if err := p.unmarshal(data); err != nil {
+			return
+		}
+		if len(p.ServerMsg) != int(p.ServerMsgLen) || len(p.Data) != int(p.DataLen) {
+			t.Fatalf("decoded fields don't match their lengths:%+v", p)
+		}
+	})
+}
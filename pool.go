@@ -0,0 +1,339 @@
+// pool.go
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultPoolMaxConns = 16
+	DefaultMaxInFlight  = 32
+)
+
+type PoolStats struct {
+	Server        string
+	SingleConnect bool //server agreed to multiplex sessions
+	MinConns      int
+	MaxConns      int
+	Shared        int //open multiplexed connections
+	Dedicated     int //open one-session connections
+	InFlight      int //sessions holding a connection
+	Waits         uint64
+	WaitTimeouts  uint64
+	Reconnects    uint64
+	Queued        uint64 //packets waiting to be written on any connection
+	KeyIndex      int    //shared key in use, index into ShareKeys
+}
+
+// connPool bounds the connections to one server. Once the server agrees to
+// single-connect sessions are spread over at most MaxConns supervised
+// connections, each carrying up to MaxInFlight sessions; until then every
+// session gets a dedicated connection, still bounded by MaxConns.
+type connPool struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	config TacacsConfig
+	server string
+	keys   []Secret
+	keyIdx int //the key that last worked, or the next one to try
+
+	singleConnect bool
+	sups          []*supervisor
+	owned         map[*Transport]struct{} //open dedicated connections
+	dedicated     int                     //len(owned) plus dials in progress
+	inFlight      int
+	freed         chan struct{} //closed and replaced whenever a slot frees up
+	closed        bool
+
+	waits        uint64
+	waitTimeouts uint64
+}
+
+func newConnPool(ctx context.Context, config TacacsConfig) *connPool {
+	p := &connPool{}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.config = config
+	p.server = net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10))
+	p.keys = config.ShareKeys
+	if len(p.keys) == 0 {
+		p.keys = []Secret{config.ShareKey}
+	}
+	p.owned = make(map[*Transport]struct{})
+	p.freed = make(chan struct{})
+	if config.AllowUnencrypted {
+		fmt.Printf("WARNING! AllowUnencrypted is on, packets to %s are sent in clear text, never use it in production\n", p.server)
+	}
+	return p
+}
+
+func (p *connPool) maxConns() int {
+	if p.config.PoolMaxConns <= 0 {
+		return DefaultPoolMaxConns
+	}
+	return p.config.PoolMaxConns
+}
+
+func (p *connPool) maxInFlight() int32 {
+	if p.config.MaxInFlight <= 0 {
+		return DefaultMaxInFlight
+	}
+	return int32(p.config.MaxInFlight)
+}
+
+func (p *connPool) keyIndex() int {
+	p.Lock()
+	defer p.Unlock()
+	return p.keyIdx
+}
+
+// nextKey gives up on key from after a reply failed to decode with it, the
+// following key is used by every new session until it fails in turn
+func (p *connPool) nextKey(from int) int {
+	p.Lock()
+	defer p.Unlock()
+	if p.keyIdx == from {
+		p.keyIdx = (from + 1) % len(p.keys)
+		fmt.Printf("shared key #%d rejected by %s, switch to key #%d\n", from, p.server, p.keyIdx)
+	}
+	return p.keyIdx
+}
+
+// setSingleConnect records that the server multiplexes sessions, connections
+// are shared from now on and MinConns of them are opened in the background
+func (p *connPool) setSingleConnect() {
+	p.Lock()
+	defer p.Unlock()
+	if p.singleConnect || !p.config.ConnMultiplexing || p.closed {
+		return
+	}
+
+	p.singleConnect = true
+	fmt.Println("server support ConnMultiplexing")
+	for len(p.sups) < p.config.PoolMinConns && len(p.sups)+p.dedicated < p.maxConns() {
+		sup := p.grow()
+		go sup.get(p.ctx)
+	}
+}
+
+// grow adds a supervised connection slot, the first MinConns are never closed
+// for idleness, must be called with the lock held
+func (p *connPool) grow() *supervisor {
+	config := p.config
+	if len(p.sups) < p.config.PoolMinConns {
+		config.IdleTimeout = 0
+	}
+	sup := newSupervisor(p.ctx, config)
+	p.sups = append(p.sups, sup)
+	return sup
+}
+
+// acquire finds a connection for sess and registers the session on it, it
+// waits for a free slot when the pool is exhausted
+func (p *connPool) acquire(ctx context.Context, sess *Session) (*Transport, bool, error) {
+	for {
+		p.Lock()
+		if p.closed {
+			p.Unlock()
+			return nil, false, errors.New("connection pool closed")
+		}
+
+		if !p.singleConnect {
+			if p.dedicated+len(p.sups) < p.maxConns() {
+				p.dedicated++
+				p.inFlight++
+				p.Unlock()
+
+				t, err := newTransport(ctx, p.config)
+				if err == nil {
+					err = t.addSession(sess.SessionID, 0)
+				}
+
+				p.Lock()
+				if err != nil {
+					p.dedicated--
+					p.inFlight--
+					p.signal()
+					p.Unlock()
+					if t != nil {
+						t.close()
+					}
+					return nil, false, err
+				}
+				p.owned[t] = struct{}{}
+				p.Unlock()
+				go p.reap(t)
+				return t, true, nil
+			}
+		} else if sup := p.pick(); sup != nil {
+			p.inFlight++
+			p.Unlock()
+
+			t, err := sup.get(ctx)
+			if err == nil {
+				if t.addSession(sess.SessionID, p.maxInFlight()) == nil {
+					return t, false, nil
+				}
+			}
+
+			p.Lock()
+			p.inFlight--
+			p.Unlock()
+			if err != nil {
+				return nil, false, err
+			}
+			//lost a race for the last slot or for a dying connection, look again
+			continue
+		}
+
+		freed := p.freed
+		p.waits++
+		p.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			p.Lock()
+			p.waitTimeouts++
+			p.Unlock()
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+// pick returns the least loaded live connection with a free slot, else a slot
+// whose connection is being (re)dialed, else a new slot, must be called with
+// the lock held
+func (p *connPool) pick() *supervisor {
+	var best, down *supervisor
+	bestLoad := p.maxInFlight()
+	for _, sup := range p.sups {
+		t := sup.current()
+		if t == nil {
+			if down == nil {
+				down = sup
+			}
+			continue
+		}
+		if load := atomic.LoadInt32(&t.sessionCnt); load < bestLoad {
+			best, bestLoad = sup, load
+		}
+	}
+
+	switch {
+	case best != nil:
+		return best
+	case down != nil:
+		return down
+	case len(p.sups)+p.dedicated < p.maxConns():
+		return p.grow()
+	}
+	return nil
+}
+
+// release gives back the slot of a session, a dedicated connection is kept as
+// a shared one when the server turned out to support single-connect
+func (p *connPool) release(t *Transport, dedicated bool) {
+	p.Lock()
+	p.inFlight--
+	p.signal()
+	if !dedicated {
+		p.Unlock()
+		return
+	}
+
+	if _, ok := p.owned[t]; ok && p.singleConnect && !p.closed && t.alive() {
+		delete(p.owned, t)
+		p.dedicated--
+		if p.adopt(t) {
+			fmt.Println("keep connection for reuse")
+			p.Unlock()
+			return
+		}
+		p.dedicated++
+		p.owned[t] = struct{}{}
+	}
+	p.Unlock()
+	t.close()
+}
+
+// adopt hands a dedicated connection to an idle slot or a new one, must be
+// called with the lock held
+func (p *connPool) adopt(t *Transport) bool {
+	for _, sup := range p.sups {
+		if sup.adopt(t) {
+			return true
+		}
+	}
+	if len(p.sups)+p.dedicated < p.maxConns() {
+		return p.grow().adopt(t)
+	}
+	return false
+}
+
+// reap frees the slot of a dedicated connection once it is gone, without
+// single-connect the server closes it when the session ends
+func (p *connPool) reap(t *Transport) {
+	<-t.failChn
+
+	p.Lock()
+	if _, ok := p.owned[t]; ok {
+		delete(p.owned, t)
+		p.dedicated--
+		p.signal()
+	}
+	p.Unlock()
+}
+
+// signal wakes up sessions waiting for a slot, must be called with the lock held
+func (p *connPool) signal() {
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+func (p *connPool) stats() PoolStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := PoolStats{}
+	stats.Server = p.server
+	stats.SingleConnect = p.singleConnect
+	stats.MinConns = p.config.PoolMinConns
+	stats.MaxConns = p.maxConns()
+	stats.Dedicated = p.dedicated
+	stats.InFlight = p.inFlight
+	stats.Waits = p.waits
+	stats.WaitTimeouts = p.waitTimeouts
+	stats.KeyIndex = p.keyIdx
+	for _, sup := range p.sups {
+		if t := sup.current(); t != nil {
+			stats.Shared++
+			stats.Queued += t.Stats().Queued
+		}
+		stats.Reconnects += sup.Reconnects()
+	}
+	for t := range p.owned {
+		stats.Queued += t.Stats().Queued
+	}
+	return stats
+}
+
+func (p *connPool) close() {
+	p.Lock()
+	p.closed = true
+	sups := p.sups
+	p.sups = nil
+	p.signal()
+	p.Unlock()
+
+	p.cancel()
+	for _, sup := range sups {
+		sup.close()
+	}
+}
@@ -0,0 +1,118 @@
+// pool_test
+package tacacs
+
+import (
+	"testing"
+)
+
+func TestPoolInFlightLimit(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.PoolMaxConns = 2
+	config.MaxInFlight = 2
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+
+	conns := make(map[*Transport]int)
+	var sessions []*Session
+	for i := 0; i < 4; i++ {
+		sess, err := NewSession(TacacsMng.ctx, 1, "alice", "")
+		if err != nil {
+			t.Fatalf("new session %d fail:%s", i, err.Error())
+		}
+		defer sess.Close()
+		conns[sess.t]++
+		sessions = append(sessions, sess)
+	}
+	if len(conns) != 2 {
+		t.Fatalf("4 sessions on %d connections, expect 2", len(conns))
+	}
+	for _, n := range conns {
+		if n != 2 {
+			t.Fatalf("in-flight limit not honored:%v", conns)
+		}
+	}
+
+	if _, err := NewSession(TacacsMng.ctx, 1, "alice", ""); err == nil {
+		t.Fatalf("exhausted pool handed out a connection")
+	}
+
+	sessions[0].Close()
+	sess, err := NewSession(TacacsMng.ctx, 1, "alice", "")
+	if err != nil {
+		t.Fatalf("freed slot not reused:%s", err.Error())
+	}
+	defer sess.Close()
+	if sess.t != sessions[0].t {
+		t.Errorf("session not placed on the connection with a free slot")
+	}
+
+	stats := TacacsPoolStats()[0]
+	if stats.Shared != 2 || stats.Dedicated != 0 || stats.InFlight != 4 || stats.Waits == 0 || stats.WaitTimeouts != 1 {
+		t.Errorf("unexpected pool stats:%+v", stats)
+	}
+}
+
+func TestPoolAdoptDedicated(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	first, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer first.Close()
+	if !first.dedicated {
+		t.Fatalf("session shares a connection before the server agreed to single-connect")
+	}
+	_, err = Author(first, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author fail:%s", err.Error())
+	}
+	first.Close()
+
+	second, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer second.Close()
+	if second.t != first.t {
+		t.Errorf("single-connect connection not reused")
+	}
+	second.Close()
+}
+
+func TestPoolDedicatedReap(t *testing.T) {
+	//without single-connect the server hangs up after every reply
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+		c.Close()
+	})
+	fakeInit(t, s)
+
+	config := s.config()
+	config.PoolMaxConns = 1
+	TacacsConfigSet(config)
+
+	for i := 0; i < 3; i++ {
+		sess, err := NewSession(TacacsMng.ctx, 1, "alice", "")
+		if err != nil {
+			t.Fatalf("slot of a finished connection not freed:%s", err.Error())
+		}
+		_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+		if err != nil {
+			t.Fatalf("author fail:%s", err.Error())
+		}
+		//the session is left open on purpose until the test ends
+		defer sess.Close()
+		<-sess.t.failChn
+	}
+}
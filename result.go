@@ -0,0 +1,27 @@
+// result.go
+package tacacs
+
+// Result is the final reply of the server to an AAA request. Operators put
+// banners, password expiry warnings and denial reasons into ServerMsg, a front
+// end is expected to show it to the user whatever the outcome.
+type Result struct {
+	Status    uint8 //reply status, AuthenStatus*, AuthorStatus* or AccountStatus*
+	ServerMsg string
+	Data      string
+	NoEcho    bool     //authentication only, the user's input must not be echoed
+	Args      []string //authorization only, the arguments the server returned
+}
+
+// setResult records the latest decoded reply of the session
+func (sess *Session) setResult(r *Result) {
+	sess.Lock()
+	sess.result = r
+	sess.Unlock()
+}
+
+// lastResult returns the latest decoded reply, nil when none arrived
+func (sess *Session) lastResult() *Result {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.result
+}
@@ -0,0 +1,62 @@
+// result_test
+package tacacs
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestResultMessages(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			reply := authenReplyBody(AuthenStatusPass, "password expires in 3 days", "banner")
+			reply[1] = ReplyFlagNoEcho
+			c.reply(hdr, reply)
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusFail, "shell not allowed"))
+		case TypeAcct:
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, "recorded"))
+		}
+	})
+	fakeInit(t, s)
+
+	r, err := AuthenPAP(5, "alice", "secret")
+	if err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	if r.Status != AuthenStatusPass || r.ServerMsg != "password expires in 3 days" || r.Data != "banner" || !r.NoEcho {
+		t.Errorf("authen result %+v", r)
+	}
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	r, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	sess.Close()
+	if err == nil {
+		t.Errorf("author passed a FAIL reply")
+	}
+	if r == nil || r.Status != AuthorStatusFail || r.ServerMsg != "shell not allowed" {
+		t.Errorf("author result %+v, expect the denial reason", r)
+	}
+
+	f, err := AccountAsync(context.Background(), 5, "alice", AccountConfig{Flags: AcctFlagStart}, "task_id=1")
+	if err != nil {
+		t.Fatalf("account not started:%s", err.Error())
+	}
+	if err := f.Err(); err != nil {
+		t.Fatalf("account fail:%s", err.Error())
+	}
+	if r := f.Result(); r == nil || r.Status != AccountStatusSuccess || r.ServerMsg != "recorded" {
+		t.Errorf("account result %+v", r)
+	}
+
+	_, err = Login(context.Background(), LoginRequest{User: "alice", Password: "secret", AuthenType: AuthenTypePAP, Timeout: 5})
+	if err == nil || !strings.Contains(err.Error(), "shell not allowed") {
+		t.Errorf("login error without the server's reason:%v", err)
+	}
+}
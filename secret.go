@@ -0,0 +1,71 @@
+// secret.go
+package tacacs
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const redacted = "<redacted>"
+
+// Secret holds a shared key or password. It prints as "<redacted>" with every
+// fmt verb and marshals the same way, only an explicit string conversion
+// reveals it.
+type Secret string
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return redacted
+}
+
+// Format keeps %x, %q and the like from printing the value
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
+
+// wipe overwrites b with zeros, for buffers that held a password
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// secretAttrs are the attribute name fragments whose values are never logged
+// or put in an event
+var secretAttrs = []string{"pass", "secret", "key", "token", "chap"}
+
+// redactArg returns an attribute-value pair with the value replaced when the
+// attribute looks secret
+func redactArg(arg string) string {
+	sep := strings.IndexAny(arg, "=*")
+	if sep < 0 {
+		return arg
+	}
+	attr := strings.ToLower(arg[:sep])
+	for _, s := range secretAttrs {
+		if strings.Contains(attr, s) {
+			return arg[:sep+1] + redacted
+		}
+	}
+	return arg
+}
+
+// redactArgs returns args with the values of secret looking attributes replaced
+func redactArgs(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = redactArg(arg)
+	}
+	return out
+}
@@ -0,0 +1,206 @@
+// secret_test
+package tacacs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSecretRedacted(t *testing.T) {
+	key := Secret("sh4red-k3y")
+	config := TacacsConfig{ShareKey: key, ShareKeys: []Secret{key}, TCPMD5Key: key}
+	req := LoginRequest{User: "alice", Password: "hunter2"}
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		for _, v := range []interface{}{key, config, req, &req} {
+			if out := fmt.Sprintf(verb, v); strings.Contains(out, "sh4red-k3y") || strings.Contains(out, "hunter2") ||
+				strings.Contains(out, fmt.Sprintf("%x", "hunter2")) {
+				t.Errorf("%s reveals the secret:%s", verb, out)
+			}
+		}
+	}
+	b, err := json.Marshal(req)
+	if err != nil || strings.Contains(string(b), "hunter2") {
+		t.Errorf("json %s, %v", b, err)
+	}
+	if string(key) != "sh4red-k3y" {
+		t.Error("conversion doesn't reveal the secret")
+	}
+
+	if got := redactArgs([]string{"service=shell", "Password=x", "chap-response*y", "priv-lvl=15"}); strings.Join(got, ",") != "service=shell,Password=<redacted>,chap-response*<redacted>,priv-lvl=15" {
+		t.Errorf("redacted args %q", got)
+	}
+}
+
+func TestPasswordWiped(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+	})
+	fakeInit(t, s)
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "hunter2")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	if _, err := sess.AuthenPAP(); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	if string(sess.Password()) != "hunter2" {
+		t.Fatalf("password %q", sess.Password())
+	}
+	sess.Lock()
+	held := sess.password
+	sess.Unlock()
+	sess.Close()
+	if !bytes.Equal(held, make([]byte, len(held))) || !bytes.Equal(sess.Password(), make([]byte, len(held))) {
+		t.Errorf("password still held after close:%q", held)
+	}
+}
+
+// recordStrategy answers like ASCII login and keeps what it hands out
+type recordStrategy struct {
+	sync.Mutex
+	sent [][]byte
+}
+
+func (r *recordStrategy) Start(sess *Session) (uint8, []byte, error) {
+	return asciiStrategy{}.Start(sess)
+}
+
+func (r *recordStrategy) Continue(sess *Session, state AuthenState, reply *Result) ([]byte, []byte, error) {
+	userMsg, data, err := asciiStrategy{}.Continue(sess, state, reply)
+	r.Lock()
+	r.sent = append(r.sent, userMsg, data)
+	r.Unlock()
+	return userMsg, data, err
+}
+
+func TestAuthenDataWiped(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		if hdr.SeqNo == 1 {
+			c.reply(hdr, authenReplyBody(AuthenStatusGetPass, "Password: ", ""))
+			return
+		}
+		if msg, _ := continueFields(body); msg != "hunter2" {
+			c.reply(hdr, authenReplyBody(AuthenStatusFail, "", ""))
+			return
+		}
+		c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+	})
+	fakeInit(t, s)
+
+	r := &recordStrategy{}
+	RegisterAuthenStrategy(AuthenTypeCHAP, r)
+	defer RegisterAuthenStrategy(AuthenTypeCHAP, nil)
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "hunter2")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	if _, err := sess.Authen(AuthenTypeCHAP); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+
+	//the password sent is a copy, wiped once in the packet
+	r.Lock()
+	defer r.Unlock()
+	if len(r.sent) != 2 || len(r.sent[0]) != len("hunter2") {
+		t.Fatalf("sent %q", r.sent)
+	}
+	if !bytes.Equal(r.sent[0], make([]byte, len(r.sent[0]))) {
+		t.Errorf("password sent still held:%q", r.sent[0])
+	}
+	if string(sess.Password()) != "hunter2" {
+		t.Errorf("session password wiped with the copy sent")
+	}
+}
+
+// captureStdout returns what fn prints
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe:%s", err.Error())
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	defer func() {
+		os.Stdout = stdout
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestNoSecretLeak(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		switch hdr.Type {
+		case TypeAuthen:
+			if hdr.SeqNo == 1 && hdr.Version == MajorVersion|MinorVersionDefault {
+				c.reply(hdr, authenReplyBody(AuthenStatusGetPass, "Password: ", ""))
+			} else {
+				c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+			}
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+		case TypeAcct:
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}
+	})
+	s.key = "sh4red-k3y"
+	fakeInit(t, s)
+	var traces bytes.Buffer
+	config := s.config()
+	config.Tracer = NewJSONTracer(&traces)
+	TacacsConfigSet(config)
+
+	var mu sync.Mutex
+	var events []string
+	unsubscribe := TacacsMng.Subscribe(AuditFunc(func(ev AuditEvent) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf("%+v", ev))
+		mu.Unlock()
+	}))
+	defer unsubscribe()
+
+	out := captureStdout(t, func() {
+		if _, err := AuthenASCII(5, "alice", "hunter2"); err != nil {
+			t.Errorf("ascii authen fail:%s", err.Error())
+		}
+		if _, err := AuthenPAP(5, "alice", "hunter2"); err != nil {
+			t.Errorf("pap authen fail:%s", err.Error())
+		}
+		sess, err := NewSession(TacacsMng.ctx, 5, "alice", "hunter2")
+		if err != nil {
+			t.Errorf("new session fail:%s", err.Error())
+			return
+		}
+		defer sess.Close()
+		if _, err := Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=ppp", "chap-response=hunter2"); err != nil {
+			t.Errorf("author fail:%s", err.Error())
+		}
+		if _, err := Account(sess, AccountConfig{Flags: AcctFlagStart}, "task_id=1", "password=hunter2"); err != nil {
+			t.Errorf("account fail:%s", err.Error())
+		}
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 4 {
+		t.Errorf("%d audit events", len(events))
+	}
+	for name, text := range map[string]string{"log": out, "trace": traces.String(), "audit": strings.Join(events, "\n")} {
+		if strings.Contains(text, "hunter2") || strings.Contains(text, "sh4red-k3y") {
+			t.Errorf("%s leaks a secret:\n%s", name, text)
+		}
+	}
+}
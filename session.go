@@ -3,28 +3,90 @@ package tacacs
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	//"errors"
 	"fmt"
-	"math/rand"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type TacacsConfig struct {
-	IPtype           string //"ip4","ip6"
+	IPtype           string //"ip4","ip6", empty dials both families
 	ServerIP         string
 	ServerPort       uint16
 	LocalIP          string
 	LocalPort        uint16
 	ConnMultiplexing bool
-	ShareKey         string
+	ShareKey         Secret
+
+	//ShareKeys replaces ShareKey with an ordered list of keys for rotation,
+	//when a reply fails to decode the next key is tried and kept
+	ShareKeys []Secret
+
+	//AllowUnencrypted sends packets with TAC_PLUS_UNENCRYPTED_FLAG and accepts
+	//unobfuscated replies, for debugging against a lab server only
+	AllowUnencrypted bool
+
+	//backoff between reconnects of a multiplexed connection, doubled after
+	//every failed attempt up to ReconnectMaxInterval
+	ReconnectInterval    time.Duration
+	ReconnectMaxInterval time.Duration
+
+	//a multiplexed connection without sessions for IdleTimeout is closed and
+	//redialed by the next request, zero keeps it open
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+	DialTimeout time.Duration
+
+	//BindDevice sends AAA traffic through a named interface or VRF device with
+	//SO_BINDTODEVICE, DSCP marks it (0-63), both are linux only
+	BindDevice string
+	DSCP       uint8
+
+	//TCPMD5Key signs every segment to the server with TCP-MD5 (RFC 2385), the
+	//server must hold the same key for this client, linux only
+	TCPMD5Key Secret
+
+	//DialFunc replaces the built-in dialer for every connection, e.g. to go
+	//through a SOCKS jump host or a relay. It gets the network picked from
+	//IPtype, the server host:port and a context bounded by DialTimeout. The
+	//LocalIP, LocalPort, KeepAlive and socket options above are then up to it.
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	//Tracer is called on every connect, packet sent or received and exchange
+	//completed, see NewJSONTracer
+	Tracer Tracer
+
+	//connections kept to the server, and sessions carried by each once the
+	//server supports single-connect
+	PoolMinConns int
+	PoolMaxConns int
+	MaxInFlight  int
 }
 
 func TacacsConfigSet(config TacacsConfig) {
 	TacacsMng.Lock()
 	defer TacacsMng.Unlock()
 	TacacsMng.Config = config
+
+	//the pooled connections belong to the old configuration
+	TacacsMng.closePools()
+}
+
+// TacacsPoolStats returns the connection statistics of every server
+func TacacsPoolStats() []PoolStats {
+	TacacsMng.Lock()
+	defer TacacsMng.Unlock()
+
+	stats := make([]PoolStats, 0, len(TacacsMng.pools))
+	for _, p := range TacacsMng.pools {
+		stats = append(stats, p.stats())
+	}
+	return stats
 }
 
 func TacacsConfigGet() (config TacacsConfig) {
@@ -36,40 +98,152 @@ func TacacsConfigGet() (config TacacsConfig) {
 
 const (
 	MaxUint8 = ^uint8(0)
+
+	//attempts to draw an unused session ID before giving up
+	maxSessionIDTries = 16
 )
 
+// CryptoSessionID draws a session ID from crypto/rand, the draft requires
+// session IDs to be unpredictable
+func CryptoSessionID() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
 type Manager struct {
 	Sessions sync.Map
 
-	Trans  *Transport
+	pools  map[string]*connPool
 	ctx    context.Context
 	cancel context.CancelFunc
 	sync.RWMutex
 
-	ServerConnMultiplexing bool
-	Config                 TacacsConfig
+	Config TacacsConfig
+
+	//SessionIDGen draws session IDs, CryptoSessionID when nil. Tests may
+	//replace it to get reproducible IDs.
+	SessionIDGen func() (uint32, error)
+
+	audit auditHub //subscribers to the audit events
+}
+
+// NewManager returns a manager for config, independent of TacacsMng
+func NewManager(config TacacsConfig) *Manager {
+	m := &Manager{Config: config}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+// Close closes every open session of the manager and its connections
+func (m *Manager) Close() {
+	m.Sessions.Range(SessionDelete)
+	m.Lock()
+	m.closePools()
+	m.Unlock()
+}
+
+// OpenSessions returns how many sessions of the manager are open
+func (m *Manager) OpenSessions() int {
+	n := 0
+	m.Sessions.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// pool returns the connection pool of the configured server, must be called
+// with the lock held
+func (m *Manager) pool() *connPool {
+	server := net.JoinHostPort(m.Config.ServerIP, strconv.FormatUint(uint64(m.Config.ServerPort), 10))
+	p, ok := m.pools[server]
+	if !ok {
+		p = newConnPool(m.ctx, m.Config)
+		if m.pools == nil {
+			m.pools = make(map[string]*connPool)
+		}
+		m.pools[server] = p
+	}
+	return p
+}
+
+// closePools must be called with the lock held
+func (m *Manager) closePools() {
+	for server, p := range m.pools {
+		p.close()
+		delete(m.pools, server)
+	}
+}
+
+type SessionState int32
+
+const (
+	SessionOpening SessionState = iota //waiting for a connection
+	SessionOpen
+	SessionClosed
+)
+
+func (s SessionState) String() string {
+	switch s {
+	case SessionOpening:
+		return "opening"
+	case SessionOpen:
+		return "open"
+	case SessionClosed:
+		return "closed"
+	}
+	return "unknown"
 }
 
+// Session holds a user's slot on a server connection. It is opened with Open
+// and must be closed with Close on every path, it can run any number of
+// authentication, authorization and accounting exchanges in between, one at a
+// time.
 type Session struct {
 	sync.Mutex
 	timeout      int
 	SessionSeqNo uint8
 	SessionID    uint32
 	UserName     string
-	Password     string
-	ReadBuffer   chan []byte
+	password     []byte //wiped when the session closes
 	mng          *Manager
 	t            *Transport
+	pool         *connPool
+	dedicated    bool //the session owns its connection
 	ctx          context.Context
 	restart      bool
+	reply        *future //reply to the last request sent
+	state        SessionState
+	used         bool    //an exchange already ran under the current session ID
+	result       *Result //latest reply decoded
+
+	//header of the last packet sent, a reply has to match it
+	reqVersion uint8
+	reqType    uint8
+
+	keyIdx   int //shared key in use, index into the server's keys
+	keyTries int
+
+	span  exchangeSpan //timings of the running exchange
+	local string       //local address of the connection in use
 }
 
+// NewSession opens a session on TacacsMng
 func NewSession(ctx context.Context, timeout int, name, passwd string) (*Session, error) {
 	if TacacsMng == nil {
 		return nil, errors.New("tacacs not init")
 	}
+	return TacacsMng.Open(ctx, timeout, name, passwd)
+}
+
+// Open reserves a session ID and a connection slot for a user, ctx bounds the
+// wait for the slot and cancels the session's exchanges
+func (m *Manager) Open(ctx context.Context, timeout int, name, passwd string) (*Session, error) {
 	sess := &Session{}
-	sess.Password = passwd
+	sess.password = []byte(passwd)
 	sess.UserName = name
 	if timeout == 0 {
 		sess.timeout = (1<<31 - 1)
@@ -78,54 +252,146 @@ func NewSession(ctx context.Context, timeout int, name, passwd string) (*Session
 	}
 
 	sess.SessionSeqNo = 1
-	sess.ReadBuffer = make(chan []byte, 10)
-	sess.mng = TacacsMng
+	sess.mng = m
 	sess.ctx = ctx
-	rand.Seed(time.Now().Unix())
-	SessionID := rand.Uint32()
-	for {
-		if _, ok := TacacsMng.Sessions.Load(SessionID); ok {
-			SessionID = rand.Uint32()
-		} else {
-			break
-		}
+	SessionID, err := sess.mng.reserveSessionID(sess)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Printf("sessionID :%d\n", SessionID)
 	sess.SessionID = SessionID
+	fmt.Printf("sessionID :%d\n", sess.SessionID)
 
 	sess.mng.Lock()
-	if sess.mng.ServerConnMultiplexing {
-		if sess.mng.Trans == nil {
-			sess.t = sess.mng.Trans
-			fmt.Println("reuse transport")
-		}
-	}
+	sess.pool = sess.mng.pool()
 	sess.mng.Unlock()
 
-	if sess.t == nil {
-		childCtx, _ := context.WithTimeout(ctx, time.Duration(sess.timeout)*time.Second)
-		t, err := newTransport(childCtx, TacacsMng.Config)
-		if err != nil {
-			fmt.Printf("create new transport fail,%s\n", err.Error())
-			return nil, err
-		} else {
-			sess.t = t
-			sess.mng.Lock()
-			if sess.mng.Trans == nil {
-				sess.mng.Trans = t
-			}
-			sess.mng.Unlock()
-		}
+	sess.keyIdx = sess.pool.keyIndex()
+	if sess.pool.config.AllowUnencrypted {
+		fmt.Printf("WARNING! session %d to %s is NOT encrypted, AllowUnencrypted is on\n", sess.SessionID, sess.pool.server)
+	}
+	if err := sess.acquire(); err != nil {
+		m.Sessions.Delete(sess.SessionID)
+		wipe(sess.password)
+		return nil, err
 	}
 
-	TacacsMng.Sessions.Store(SessionID, sess)
+	sess.Lock()
+	sess.state = SessionOpen
+	sess.Unlock()
 	return sess, nil
 }
 
+// acquire gets the session a connection slot
+func (sess *Session) acquire() error {
+	//the context only bounds waiting for a connection
+	childCtx, cancel := context.WithTimeout(sess.ctx, time.Duration(sess.timeout)*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	t, dedicated, err := sess.pool.acquire(childCtx, sess)
+	sess.span.dial += time.Since(start)
+	if err != nil {
+		fmt.Printf("get transport fail,%s\n", err.Error())
+		return err
+	}
+	sess.Lock()
+	sess.t = t
+	sess.dedicated = dedicated
+	sess.local = t.netConn.nc.LocalAddr().String()
+	sess.Unlock()
+	return nil
+}
+
+// State returns where the session is in its lifecycle
+func (sess *Session) State() SessionState {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.state
+}
+
+// begin readies the session for an exchange. The first one runs under the ID
+// reserved by Open, every later one under a fresh ID since a finished
+// session's ID must not be reused. A connection the server may close after an
+// exchange, or one already gone, is replaced.
+func (sess *Session) begin() error {
+	sess.Lock()
+	state, used := sess.state, sess.used
+	sess.used = true
+	//an exchange that never starts has no result either
+	sess.result = nil
+	sess.Unlock()
+	if state != SessionOpen {
+		return errors.New("session " + state.String() + ", not open")
+	}
+	if !used {
+		return nil
+	}
+
+	SessionID, err := sess.mng.reserveSessionID(sess)
+	if err != nil {
+		return err
+	}
+	sess.Lock()
+	old := sess.SessionID
+	sess.SessionID = SessionID
+	sess.SessionSeqNo = 1
+	sess.restart = false
+	sess.result = nil
+	sess.keyTries = 0
+	sess.Unlock()
+	sess.span = exchangeSpan{}
+	sess.t.removeSession(old)
+	sess.mng.Sessions.Delete(old)
+	fmt.Printf("reuse session %d as %d\n", old, SessionID)
+	return sess.reconnect(SessionID)
+}
+
+// reconnect registers SessionID on the session's connection, or replaces the
+// connection when it's dedicated or already gone. The session is closed when
+// no connection can be had.
+func (sess *Session) reconnect(SessionID uint32) error {
+	if !sess.dedicated && sess.t.alive() && sess.t.addSession(SessionID, 0) == nil {
+		return nil
+	}
+
+	sess.pool.release(sess.t, sess.dedicated)
+	if err := sess.acquire(); err != nil {
+		sess.Lock()
+		sess.state = SessionClosed
+		sess.t = nil
+		wipe(sess.password)
+		sess.Unlock()
+		sess.mng.Sessions.Delete(SessionID)
+		return err
+	}
+	return nil
+}
+
+// reserveSessionID draws an unused session ID and claims it for sess in the
+// session table, so two sessions can never share one
+func (m *Manager) reserveSessionID(sess *Session) (uint32, error) {
+	gen := m.SessionIDGen
+	if gen == nil {
+		gen = CryptoSessionID
+	}
+
+	for i := 0; i < maxSessionIDTries; i++ {
+		SessionID, err := gen()
+		if err != nil {
+			fmt.Printf("generate session id fail,%s\n", err.Error())
+			return 0, err
+		}
+		if _, loaded := m.Sessions.LoadOrStore(SessionID, sess); !loaded {
+			return SessionID, nil
+		}
+	}
+	return 0, errors.New("no free session id")
+}
+
 func SessionDelete(key, value interface{}) bool {
 	sess, ok := value.(*Session)
 	if ok {
-		sess.close()
+		sess.Close()
 	} else {
 		fmt.Printf("*** error, interface assert fail ***\n")
 	}
@@ -136,8 +402,7 @@ var TacacsMng *Manager
 
 func TacacsInit() {
 	if TacacsMng == nil {
-		TacacsMng = &Manager{}
-		TacacsMng.ctx, TacacsMng.cancel = context.WithCancel(context.Background())
+		TacacsMng = NewManager(TacacsConfig{})
 		fmt.Printf("--> tacacs init success\n")
 	} else {
 		fmt.Printf("--> tacacs already init\n")
@@ -149,25 +414,177 @@ func TacacsExit() {
 		fmt.Println("error, tacacs not init, exit fail")
 	} else {
 		fmt.Println("close session....")
-		TacacsMng.Sessions.Range(SessionDelete)
-		TacacsMng.Lock()
-		if TacacsMng.Trans != nil {
-			TacacsMng.Trans.close()
-		}
-		TacacsMng.Unlock()
+		TacacsMng.Close()
 		fmt.Printf("TACACS exit success\n")
 	}
 }
 
-func (sess *Session) close() {
+// Close releases the session's ID and connection slot, it is safe to call
+// more than once and from any goroutine
+func (sess *Session) Close() {
+	sess.Lock()
+	if sess.state != SessionOpen {
+		//still being set up by Open, or closed already
+		sess.Unlock()
+		return
+	}
+	sess.state = SessionClosed
+	SessionID, t, dedicated := sess.SessionID, sess.t, sess.dedicated
+	wipe(sess.password)
+	sess.Unlock()
+
+	sess.mng.Sessions.Delete(SessionID)
+	t.removeSession(SessionID)
+	sess.pool.release(t, dedicated)
+	fmt.Println("session close success")
+}
+
+// Password returns a copy of the user's password for an AuthenStrategy, the
+// caller should wipe it once used. It is empty once the session is closed.
+func (sess *Session) Password() []byte {
+	sess.Lock()
+	defer sess.Unlock()
+	return append([]byte(nil), sess.password...)
+}
+
+// shareKey returns a copy of the key the session's packets are obfuscated
+// with, the caller wipes it once used
+func (sess *Session) shareKey() []byte {
+	return []byte(sess.pool.keys[sess.keyIdx])
+}
+
+// obfuscate encrypts an outgoing packet with the shared key, or marks it as
+// unencrypted when the debug mode is enabled
+func (sess *Session) obfuscate(p []byte) {
+	if sess.pool.config.AllowUnencrypted {
+		p[FlagsOffset] |= UnencryptedFlag
+		return
+	}
+	key := sess.shareKey()
+	crypt(p, key)
+	wipe(key)
+}
+
+// deobfuscate decrypts a reply, an unencrypted one is refused unless the debug
+// mode is enabled
+func (sess *Session) deobfuscate(p []byte) error {
+	if p[FlagsOffset]&UnencryptedFlag != 0 {
+		if !sess.pool.config.AllowUnencrypted {
+			fmt.Printf("Warning! unencrypted packet,not allowed\n")
+			return &ProtocolError{Reason: "unencrypted reply while AllowUnencrypted is off"}
+		}
+		return nil
+	}
+	key := sess.shareKey()
+	crypt(p, key)
+	wipe(key)
+	return nil
+}
+
+// rekey moves the session to the server's next shared key after a reply
+// failed to decode. The server has finished the exchange, so it is started
+// again under a fresh session ID. False once every key has been tried.
+func (sess *Session) rekey() bool {
+	tacacsMetrics.badSecretSeen(sess.pool.server)
+	sess.keyTries++
+	if sess.keyTries >= len(sess.pool.keys) {
+		return false
+	}
+
+	sess.Lock()
+	sess.keyIdx = sess.pool.nextKey(sess.keyIdx)
+	sess.Unlock()
+	if err := sess.renew(); err != nil {
+		return false
+	}
+	fmt.Printf("retry with shared key #%d, sessionID :%d\n", sess.keyIdx, sess.SessionID)
+	return true
+}
+
+// renew moves the session to a fresh session ID, for an exchange that is
+// started over from its START
+func (sess *Session) renew() error {
+	SessionID, err := sess.mng.reserveSessionID(sess)
+	if err != nil {
+		return err
+	}
+	sess.t.removeSession(sess.SessionID)
 	sess.mng.Sessions.Delete(sess.SessionID)
-	sess.mng.Lock()
-	if !sess.mng.ServerConnMultiplexing {
-		if sess.mng.Trans == sess.t {
-			sess.t.close()
-			sess.mng.Trans = nil
+
+	sess.Lock()
+	sess.SessionID = SessionID
+	sess.SessionSeqNo = 1
+	sess.restart = false
+	sess.Unlock()
+	return sess.reconnect(SessionID)
+}
+
+// nextSeqNo returns the seq_no of the next packet sent and remembers the
+// version and type a reply to it must carry, must be called with the lock held
+func (sess *Session) nextSeqNo(version, tacacsType uint8) uint8 {
+	seqNo := sess.SessionSeqNo
+	sess.SessionSeqNo++
+	sess.reqVersion = version
+	sess.reqType = tacacsType
+	return seqNo
+}
+
+// checkReply enforces the draft's rules on a reply header: same session, type
+// and version as the request, and a seq_no of exactly request+1, which is
+// always even. A violation resets the connection.
+func (sess *Session) checkReply(h *TacacsHeader) error {
+	sess.Lock()
+	var reason string
+	switch {
+	case h.SessionID != sess.SessionID:
+		reason = fmt.Sprintf("session id %d, expect %d", h.SessionID, sess.SessionID)
+	case h.Type != sess.reqType:
+		reason = fmt.Sprintf("packet type %d, expect %d", h.Type, sess.reqType)
+	case h.Version != sess.reqVersion:
+		reason = fmt.Sprintf("version 0x%x, expect 0x%x", h.Version, sess.reqVersion)
+	case h.SeqNo%2 != 0:
+		reason = fmt.Sprintf("odd seq_no %d in a reply", h.SeqNo)
+	case h.SeqNo != sess.SessionSeqNo:
+		reason = fmt.Sprintf("seq_no %d, expect %d", h.SeqNo, sess.SessionSeqNo)
+	}
+
+	if reason == "" {
+		sess.SessionSeqNo++
+		if sess.SessionSeqNo == 255 {
+			//no room left for another request and its reply
+			sess.restart = true
 		}
+		sess.Unlock()
+		return nil
 	}
-	sess.mng.Unlock()
-	fmt.Println("session close success")
+	sess.Unlock()
+
+	err := &ProtocolError{Reason: reason}
+	fmt.Printf("session %d: %s, reset connection\n", sess.SessionID, err.Error())
+	sess.t.fail(err)
+	return err
+}
+
+// send hands a packet of the session to the transport, the reply is picked up
+// with pending
+func (sess *Session) send(data []byte) error {
+	sess.Lock()
+	SessionID := sess.SessionID
+	sess.Unlock()
+
+	f, err := sess.t.request(SessionID, data)
+	if err != nil {
+		return err
+	}
+	sess.Lock()
+	sess.reply = f
+	sess.Unlock()
+	return nil
+}
+
+// pending returns the future of the reply to the last packet sent
+func (sess *Session) pending() *future {
+	sess.Lock()
+	defer sess.Unlock()
+	return sess.reply
 }
@@ -2,7 +2,11 @@
 package tacacs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,5 +31,263 @@ func TestConn(t *testing.T) {
 	} else {
 		fmt.Printf("NewSession success,id:%d\n", sess.SessionID)
 	}
+	defer sess.Close()
 	time.Sleep(1000 * time.Second)
 }
+
+func TestSessionIDUnique(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {})
+	fakeInit(t, s)
+
+	ids := []uint32{7, 7, 7, 9}
+	TacacsMng.SessionIDGen = func() (uint32, error) {
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+	defer func() { TacacsMng.SessionIDGen = nil }()
+
+	first, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer first.Close()
+	second, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer second.Close()
+	if first.SessionID != 7 || second.SessionID != 9 {
+		t.Errorf("session ids %d,%d, expect 7,9", first.SessionID, second.SessionID)
+	}
+}
+
+func TestCryptoSessionID(t *testing.T) {
+	seen := make(map[uint32]bool)
+	for i := 0; i < 1000; i++ {
+		id, err := CryptoSessionID()
+		if err != nil {
+			t.Fatalf("generate session id fail:%s", err.Error())
+		}
+		seen[id] = true
+	}
+	//a birthday collision among 1000 draws from 2^32 is very unlikely
+	if len(seen) < 999 {
+		t.Errorf("only %d distinct session ids in 1000 draws", len(seen))
+	}
+}
+
+func TestReplyValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		mangle func(h *TacacsHeader)
+		//reply body, an author reply when nil
+		body []byte
+	}{
+		{"odd seq_no", func(h *TacacsHeader) { h.SeqNo-- }, nil},
+		{"skipped seq_no", func(h *TacacsHeader) { h.SeqNo += 2 }, nil},
+		{"type", func(h *TacacsHeader) { h.Type = TypeAcct }, nil},
+		{"type and body", func(h *TacacsHeader) { h.Type = TypeAcct }, acctReplyBody(AccountStatusSuccess, "")},
+		{"minor version", func(h *TacacsHeader) { h.Version = MajorVersion | MinorVersionOne }, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newFakeServer(t, func(conn *fakeConn, hdr TacacsHeader, body []byte) {
+				hdr.SeqNo++
+				c.mangle(&hdr)
+				reply := c.body
+				if reply == nil {
+					reply = authorReplyBody(AuthorStatusPassAdd, "")
+				}
+				conn.write(hdr, reply)
+			})
+			fakeInit(t, s)
+
+			sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+			if err != nil {
+				t.Fatalf("new session fail:%s", err.Error())
+			}
+			defer sess.Close()
+			_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+			var perr *ProtocolError
+			if !errors.As(err, &perr) {
+				t.Fatalf("bad reply accepted:%v", err)
+			}
+			if sess.t.alive() {
+				t.Errorf("connection not reset after a protocol error")
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	testKeyRotation(t, false)
+}
+
+func TestKeyRotationHangUp(t *testing.T) {
+	//without single-connect the retry needs a new connection
+	testKeyRotation(t, true)
+}
+
+// testKeyRotation checks a reply under the retired key is retried with the
+// rotated one, hangUp closes the connection after every reply
+func testKeyRotation(t *testing.T, hangUp bool) {
+	var requests int32
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		atomic.AddInt32(&requests, 1)
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+		}
+		if hangUp {
+			c.Close()
+		}
+	})
+	s.key = "rotated"
+	fakeInit(t, s)
+	config := s.config()
+	config.ShareKeys = []Secret{"retired", "rotated"}
+	TacacsConfigSet(config)
+
+	//fixed session ids make the garbage decoded with the old key reproducible
+	id := uint32(0x2000)
+	TacacsMng.SessionIDGen = func() (uint32, error) {
+		id++
+		return id, nil
+	}
+	defer func() { TacacsMng.SessionIDGen = nil }()
+
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author not retried with the next key:%s", err.Error())
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%d requests, expect one per key", n)
+	}
+	if idx := TacacsPoolStats()[0].KeyIndex; idx != 1 {
+		t.Errorf("key in use #%d, expect #1", idx)
+	}
+
+	//the key that worked is remembered
+	if _, err := AuthenPAP(5, "alice", "secret"); err != nil {
+		t.Fatalf("authen with the remembered key fail:%s", err.Error())
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("%d requests, the remembered key wasn't used first", n)
+	}
+}
+
+func TestUnencrypted(t *testing.T) {
+	var flags uint32
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		atomic.StoreUint32(&flags, uint32(hdr.Flags))
+		if authorUser(body) != "alice" {
+			c.reply(hdr, authorReplyBody(AuthorStatusFail, ""))
+			return
+		}
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = UnencryptedFlag
+	fakeInit(t, s)
+
+	//never on by default, an unencrypted reply is refused
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("unencrypted reply accepted by default:%v", err)
+	}
+
+	config := s.config()
+	config.AllowUnencrypted = true
+	TacacsConfigSet(config)
+
+	sess, err = NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author in unencrypted mode fail:%s", err.Error())
+	}
+	if atomic.LoadUint32(&flags)&uint32(UnencryptedFlag) == 0 {
+		t.Errorf("request sent without the unencrypted flag")
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	var mu sync.Mutex
+	ids := make(map[uint32]bool)
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		mu.Lock()
+		ids[hdr.SessionID] = true
+		mu.Unlock()
+		switch hdr.Type {
+		case TypeAuthen:
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		case TypeAuthor:
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+		case TypeAcct:
+			c.reply(hdr, acctReplyBody(AccountStatusSuccess, ""))
+		}
+		//no single-connect, the server hangs up after every exchange
+		c.Close()
+	})
+	fakeInit(t, s)
+
+	m := NewManager(s.config())
+	defer m.Close()
+	sess, err := m.Open(context.Background(), 5, "alice", "secret")
+	if err != nil {
+		t.Fatalf("open fail:%s", err.Error())
+	}
+	if sess.State() != SessionOpen {
+		t.Fatalf("state %s after open", sess.State())
+	}
+
+	if _, err := sess.AuthenPAP(); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+	if _, err := Author(sess, AuthenMethodTACACSPLUS, PrivLvlRoot, AuthenTypePAP, AuthenServiceLogin, "service=shell"); err != nil {
+		t.Fatalf("author on the reused session fail:%s", err.Error())
+	}
+	if _, err := Account(sess, AccountConfig{Flags: AcctFlagStart}, "task_id=1"); err != nil {
+		t.Fatalf("account on the reused session fail:%s", err.Error())
+	}
+	mu.Lock()
+	if len(ids) != 3 {
+		t.Errorf("%d session ids for 3 exchanges", len(ids))
+	}
+	mu.Unlock()
+	if n := m.OpenSessions(); n != 1 {
+		t.Errorf("%d sessions in the table, expect 1", n)
+	}
+
+	sess.Close()
+	sess.Close()
+	if sess.State() != SessionClosed {
+		t.Errorf("state %s after close", sess.State())
+	}
+	if n := m.OpenSessions(); n != 0 {
+		t.Errorf("%d sessions left in the table", n)
+	}
+	if r, err := Author(sess, AuthenMethodTACACSPLUS, PrivLvlRoot, AuthenTypePAP, AuthenServiceLogin, "service=shell"); err == nil || r != nil {
+		t.Errorf("author on a closed session:%+v, %v", r, err)
+	}
+	if TacacsMng.OpenSessions() != 0 {
+		t.Errorf("manager sessions leaked into TacacsMng")
+	}
+}
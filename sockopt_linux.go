@@ -0,0 +1,134 @@
+// sockopt_linux.go
+package tacacs
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// tcpMD5SigMaxKeyLen is TCP_MD5SIG_MAXKEYLEN of linux/tcp.h
+const tcpMD5SigMaxKeyLen = 80
+
+// control returns the dialer hook applying the socket options of config
+// before connecting, nil when there are none
+func control(config TacacsConfig) (func(network, address string, c syscall.RawConn) error, error) {
+	if config.DSCP > 63 {
+		return nil, errors.New("invalid DSCP, must be in 0-63")
+	}
+	if len(config.TCPMD5Key) > tcpMD5SigMaxKeyLen {
+		return nil, errors.New("TCP-MD5 key longer than 80 bytes")
+	}
+	if config.BindDevice == "" && config.DSCP == 0 && config.TCPMD5Key == "" {
+		return nil, nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = setSockopts(int(fd), network, address, config)
+		})
+		if cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			//a local setting the kernel refused, not a server that can't be reached
+			return &ConfigError{Err: err}
+		}
+		return nil
+	}, nil
+}
+
+func setSockopts(fd int, network, address string, config TacacsConfig) error {
+	if config.BindDevice != "" {
+		err := syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, config.BindDevice)
+		if err != nil {
+			return errors.New("bind to device " + config.BindDevice + " fail, " + err.Error())
+		}
+	}
+
+	if config.DSCP != 0 {
+		//DSCP is the upper six bits of the TOS / traffic class byte
+		tos := int(config.DSCP) << 2
+		var err error
+		if network == "tcp6" {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+		if err != nil {
+			return errors.New("set DSCP fail, " + err.Error())
+		}
+	}
+
+	if config.TCPMD5Key != "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if err := setMD5Sig(fd, net.ParseIP(host), string(config.TCPMD5Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetListenerMD5Sig makes ln accept only connections from peer that are signed
+// with key (RFC 2385), call it once for every peer
+func SetListenerMD5Sig(ln *net.TCPListener, peer, key string) error {
+	ip := net.ParseIP(peer)
+	if ip == nil {
+		return errors.New("invalid TCP-MD5 peer " + peer)
+	}
+	if len(key) > tcpMD5SigMaxKeyLen {
+		return errors.New("TCP-MD5 key longer than 80 bytes")
+	}
+
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		err = setMD5Sig(int(fd), ip, key)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// setMD5Sig installs key for peer with TCP_MD5SIG, the option takes a struct
+// tcp_md5sig: a sockaddr_storage, flags, prefixlen, keylen, ifindex and key
+func setMD5Sig(fd int, peer net.IP, key string) error {
+	if peer == nil {
+		return errors.New("TCP-MD5 needs a peer address")
+	}
+
+	sig := make([]byte, 128+1+1+2+4+tcpMD5SigMaxKeyLen)
+	if ip4 := peer.To4(); ip4 != nil {
+		family, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+		if err == nil && family == syscall.AF_INET6 {
+			//v4 peer on a dual-stack socket
+			binary.NativeEndian.PutUint16(sig, syscall.AF_INET6)
+			copy(sig[8:], peer.To16())
+		} else {
+			binary.NativeEndian.PutUint16(sig, syscall.AF_INET)
+			copy(sig[4:], ip4)
+		}
+	} else {
+		binary.NativeEndian.PutUint16(sig, syscall.AF_INET6)
+		copy(sig[8:], peer.To16())
+	}
+	binary.NativeEndian.PutUint16(sig[130:], uint16(len(key)))
+	copy(sig[136:], key)
+
+	err := syscall.SetsockoptString(fd, syscall.IPPROTO_TCP, syscall.TCP_MD5SIG, string(sig))
+	switch err {
+	case nil:
+		return nil
+	case syscall.ENOPROTOOPT, syscall.ENOENT:
+		return errors.New("TCP-MD5 not supported by the kernel, " + err.Error())
+	}
+	return errors.New("set TCP-MD5 key for " + peer.String() + " fail, " + err.Error())
+}
@@ -0,0 +1,114 @@
+// sockopt_linux_test
+package tacacs
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBindDevice(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	config := s.config()
+	config.BindDevice = "tacacs-none0"
+	TacacsConfigSet(config)
+	_, err := NewSession(TacacsMng.ctx, 1, "alice", "")
+	if err == nil || !strings.Contains(err.Error(), "tacacs-none0") {
+		t.Fatalf("bind to a missing device:%v", err)
+	}
+
+	config.BindDevice = "lo"
+	config.DSCP = 46
+	TacacsConfigSet(config)
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Skipf("bind to lo fail, needs CAP_NET_RAW on old kernels:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author through lo fail:%s", err.Error())
+	}
+
+	rc, err := sess.t.netConn.nc.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("raw conn fail:%s", err.Error())
+	}
+	var tos int
+	rc.Control(func(fd uintptr) {
+		tos, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if tos != 46<<2 {
+		t.Errorf("tos %#x, expect %#x", tos, 46<<2)
+	}
+}
+
+func TestDSCPRange(t *testing.T) {
+	if _, err := control(TacacsConfig{DSCP: 64}); err == nil {
+		t.Errorf("DSCP 64 accepted")
+	}
+}
+
+func TestTCPMD5(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail:%s", err.Error())
+	}
+	err = SetListenerMD5Sig(ln.(*net.TCPListener), "127.0.0.1", "md5secret")
+	if err != nil {
+		ln.Close()
+		if strings.Contains(err.Error(), "not supported") {
+			t.Skip(err.Error())
+		}
+		t.Fatalf("set listener key fail:%s", err.Error())
+	}
+
+	s := serveFake(ln, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	//unsigned and wrongly signed SYNs are dropped by the server's kernel
+	config := s.config()
+	config.DialTimeout = 200 * time.Millisecond
+	for _, key := range []string{"", "wrong"} {
+		config.TCPMD5Key = Secret(key)
+		TacacsConfigSet(config)
+		if _, err := NewSession(TacacsMng.ctx, 1, "alice", ""); err == nil {
+			t.Errorf("connected with TCP-MD5 key %q", key)
+		}
+	}
+
+	config.TCPMD5Key = "md5secret"
+	TacacsConfigSet(config)
+	sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session with TCP-MD5 fail:%s", err.Error())
+	}
+	defer sess.Close()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author with TCP-MD5 fail:%s", err.Error())
+	}
+}
+
+func TestTCPMD5Errors(t *testing.T) {
+	if _, err := control(TacacsConfig{TCPMD5Key: Secret(strings.Repeat("k", 81))}); err == nil {
+		t.Errorf("81 byte TCP-MD5 key accepted")
+	}
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail:%s", err.Error())
+	}
+	defer ln.Close()
+	if err := SetListenerMD5Sig(ln.(*net.TCPListener), "peer", "key"); err == nil {
+		t.Errorf("invalid peer accepted")
+	}
+}
@@ -0,0 +1,26 @@
+// sockopt_other.go
+
+//go:build !linux
+
+package tacacs
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// control returns the dialer hook applying the socket options of config, they
+// are only supported on Linux
+func control(config TacacsConfig) (func(network, address string, c syscall.RawConn) error, error) {
+	if config.BindDevice != "" || config.DSCP != 0 || config.TCPMD5Key != "" {
+		return nil, errors.New("BindDevice, DSCP and TCPMD5Key are only supported on linux")
+	}
+	return nil, nil
+}
+
+// SetListenerMD5Sig makes ln accept only connections from peer that are signed
+// with key (RFC 2385), it is only supported on Linux
+func SetListenerMD5Sig(ln *net.TCPListener, peer, key string) error {
+	return errors.New("TCP-MD5 is only supported on linux")
+}
@@ -0,0 +1,240 @@
+// supervisor.go
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultReconnectInterval    = 500 * time.Millisecond
+	DefaultReconnectMaxInterval = 30 * time.Second
+)
+
+// supervisor owns the multiplexed transport of a server. When the connection
+// fails it is redialed in the background with jittered exponential backoff,
+// and sessions asking for a transport meanwhile wait for the next attempt.
+type supervisor struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	config TacacsConfig
+	server string
+
+	cur     *Transport
+	running bool          //reconnect loop active
+	attempt chan struct{} //closed when the pending connection attempt finishes
+	lastErr error
+	closed  bool
+
+	reconnects uint64
+}
+
+func newSupervisor(ctx context.Context, config TacacsConfig) *supervisor {
+	s := &supervisor{}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.config = config
+	s.server = net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10))
+	return s
+}
+
+// get returns the live transport, a caller arriving while the connection is
+// down waits for at most the next connection attempt
+func (s *supervisor) get(ctx context.Context) (*Transport, error) {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil, errors.New("transport supervisor closed")
+	}
+	if s.cur != nil {
+		if s.cur.alive() {
+			t := s.cur
+			s.Unlock()
+			return t, nil
+		}
+		//failed, but the watcher hasn't noticed yet
+		s.lost(s.cur)
+	}
+	if !s.running {
+		s.start(false)
+	}
+	attempt := s.attempt
+	s.Unlock()
+
+	select {
+	case <-attempt:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.cur != nil {
+		return s.cur, nil
+	}
+	if s.lastErr == nil {
+		return nil, errors.New("transport supervisor closed")
+	}
+	return nil, &TransportError{Err: s.lastErr}
+}
+
+// adopt hands a transport dialed for a single session to the supervisor, it
+// becomes the shared transport once the server agrees to single-connect
+func (s *supervisor) adopt(t *Transport) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed || s.running || (s.cur != nil && s.cur.alive()) {
+		return false
+	}
+
+	s.cur = t
+	go s.watch(t)
+	return true
+}
+
+// current returns the live transport without dialing, nil when there is none
+func (s *supervisor) current() *Transport {
+	s.Lock()
+	defer s.Unlock()
+	if s.cur != nil && s.cur.alive() {
+		return s.cur
+	}
+	return nil
+}
+
+// Reconnects returns how many times the connection was redialed after a failure
+func (s *supervisor) Reconnects() uint64 {
+	return atomic.LoadUint64(&s.reconnects)
+}
+
+// start launches the reconnect loop, must be called with the lock held
+func (s *supervisor) start(backoff bool) {
+	s.running = true
+	s.attempt = make(chan struct{})
+	go s.reconnect(backoff)
+}
+
+func (s *supervisor) watch(t *Transport) {
+	if idle := s.config.IdleTimeout; idle > 0 {
+		ticker := time.NewTicker(idle / 2)
+		for done := false; !done; {
+			select {
+			case <-t.failChn:
+				done = true
+			case <-ticker.C:
+				done = t.closeIfIdle(idle)
+			}
+		}
+		ticker.Stop()
+	} else {
+		<-t.failChn
+	}
+
+	s.Lock()
+	s.lost(t)
+	s.Unlock()
+}
+
+// lost drops a failed transport and starts redialing, must be called with the
+// lock held
+func (s *supervisor) lost(t *Transport) {
+	if s.cur != t {
+		return
+	}
+	s.cur = nil
+
+	//a transport closed on purpose is redialed lazily by the next session
+	if !t.isClosing() && !s.closed && !s.running {
+		atomic.AddUint64(&s.reconnects, 1)
+		tacacsMetrics.reconnectSeen(s.server)
+		fmt.Printf("transport to %s lost, reconnecting\n", s.config.ServerIP)
+		s.start(true)
+	}
+}
+
+func (s *supervisor) reconnect(backoff bool) {
+	min, max := s.config.ReconnectInterval, s.config.ReconnectMaxInterval
+	if min <= 0 {
+		min = DefaultReconnectInterval
+	}
+	if max < min {
+		max = DefaultReconnectMaxInterval
+		if max < min {
+			max = min
+		}
+	}
+
+	delay := min
+	for {
+		if backoff {
+			select {
+			case <-time.After(jitter(delay)):
+			case <-s.ctx.Done():
+			}
+			delay *= 2
+			if delay > max {
+				delay = max
+			}
+		}
+		backoff = true
+
+		t, err := newTransport(s.ctx, s.config)
+
+		s.Lock()
+		done := s.attempt
+		if s.closed {
+			s.running = false
+			s.Unlock()
+			close(done)
+			if t != nil {
+				t.close()
+			}
+			return
+		}
+
+		if err == nil {
+			s.cur = t
+			s.lastErr = nil
+			s.running = false
+			s.Unlock()
+			close(done)
+			go s.watch(t)
+			return
+		}
+
+		fmt.Printf("reconnect %s fail, %s\n", s.config.ServerIP, err.Error())
+		s.lastErr = err
+		s.attempt = make(chan struct{})
+		s.Unlock()
+		close(done)
+	}
+}
+
+func (s *supervisor) close() {
+	s.Lock()
+	s.closed = true
+	t := s.cur
+	s.cur = nil
+	s.Unlock()
+
+	s.cancel()
+	if t != nil {
+		t.close()
+	}
+}
+
+// jitter spreads reconnects of many clients over [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
@@ -0,0 +1,144 @@
+// supervisor_test
+package tacacs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSupervisorReconnect(t *testing.T) {
+	var requests int32
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		//the first connection dies under its first request
+		if atomic.AddInt32(&requests, 1) == 1 {
+			c.Close()
+			return
+		}
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.ReconnectInterval = 10 * time.Millisecond
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+	reconnects := `tacacs_reconnects_total{server="` + config.ServerIP + ":" + strconv.Itoa(int(s.port())) + `"}`
+	before := scrape(t)[reconnects]
+
+	first, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer first.Close()
+	_, err = Author(first, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	var terr *TransportError
+	if !errors.As(err, &terr) {
+		t.Fatalf("in-flight session not failed with a transport error:%v", err)
+	}
+	first.Close()
+
+	second, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session after reconnect fail:%s", err.Error())
+	}
+	defer second.Close()
+	if second.t == first.t {
+		t.Fatalf("new session routed to the dead transport")
+	}
+	_, err = Author(second, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author after reconnect fail:%s", err.Error())
+	}
+	second.Close()
+
+	if n := TacacsPoolStats()[0].Reconnects; n != 1 {
+		t.Errorf("reconnects:%d, expect 1", n)
+	}
+
+	//the counter outlives the pool
+	TacacsConfigSet(config)
+	if got := scrape(t)[reconnects] - before; got != 1 {
+		t.Errorf("%s moved by %v after the pool was closed, expect 1", reconnects, got)
+	}
+}
+
+func TestSupervisorServerDown(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {})
+	config := s.config()
+	config.ReconnectInterval = 10 * time.Millisecond
+	s.close()
+
+	mux := newSupervisor(context.Background(), config)
+	defer mux.close()
+
+	_, err := mux.get(context.Background())
+	var terr *TransportError
+	if !errors.As(err, &terr) {
+		t.Fatalf("get on a dead server:%v, expect a transport error", err)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		if d < 500*time.Millisecond || d >= time.Second {
+			t.Fatalf("jitter out of range:%s", d)
+		}
+	}
+}
+
+func TestSupervisorIdleClose(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.IdleTimeout = 50 * time.Millisecond
+	config.KeepAlive = time.Second
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+
+	first, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer first.Close()
+	_, err = Author(first, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author fail:%s", err.Error())
+	}
+
+	//a connection with a session on it is never idle
+	time.Sleep(150 * time.Millisecond)
+	if !first.t.alive() {
+		t.Fatalf("connection closed while a session was open")
+	}
+	first.Close()
+
+	time.Sleep(150 * time.Millisecond)
+	if first.t.alive() {
+		t.Fatalf("idle connection not closed")
+	}
+
+	second, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session after idle close fail:%s", err.Error())
+	}
+	defer second.Close()
+	_, err = Author(second, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author after idle close fail:%s", err.Error())
+	}
+	second.Close()
+
+	if n := TacacsPoolStats()[0].Reconnects; n != 0 {
+		t.Errorf("idle close counted as %d reconnects", n)
+	}
+}
@@ -0,0 +1,214 @@
+// trace.go
+package tacacs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tracer is told about every connection dialed and every packet and exchange
+// of the sessions, set it with TacacsConfig.Tracer. Its methods are called
+// from the session and transport goroutines, they must be safe for concurrent
+// use and must not block.
+type Tracer interface {
+	OnConnect(ev ConnectEvent)
+	OnSend(ev PacketEvent)
+	OnReceive(ev PacketEvent)
+	OnComplete(ev ExchangeEvent)
+}
+
+// ConnectEvent is a connection dialed to a server
+type ConnectEvent struct {
+	Server   string
+	Local    string //local address, empty when the dial failed
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// PacketEvent is a packet written to or read from a server
+type PacketEvent struct {
+	Server    string
+	SessionID uint32
+	Type      uint8
+	SeqNo     uint8
+	Length    uint32        //body length
+	Time      time.Time     //when the packet was written or read
+	Queued    time.Duration //sent packets only, time waiting for the write loop
+}
+
+// ExchangeEvent is a finished authentication, authorization or accounting
+// exchange, the timings add up the packets of the exchange
+type ExchangeEvent struct {
+	Server     string
+	SessionID  uint32
+	Type       uint8
+	Start      time.Time
+	Duration   time.Duration
+	Dial       time.Duration //getting a connection, dial or pool wait
+	Queued     time.Duration //packets waiting for the write loop
+	ServerTime time.Duration //from each packet written to its reply read
+	Decode     time.Duration //from the last reply read to the end
+	Result     string        //pass, fail, timeout, bad_secret or error
+	Err        error
+}
+
+// exchangeSpan collects the timings of the running exchange, it belongs to
+// the goroutine driving the session
+type exchangeSpan struct {
+	dial     time.Duration
+	queued   time.Duration
+	server   time.Duration
+	received time.Time //last reply read
+}
+
+// packetEvent describes the packet data, header included, at t
+func packetEvent(server string, data []byte, t time.Time) PacketEvent {
+	return PacketEvent{
+		Server:    server,
+		SessionID: binary.BigEndian.Uint32(data[SessionIDOffset:]),
+		Type:      data[TypeOffset],
+		SeqNo:     data[SeqNoOffset],
+		Length:    binary.BigEndian.Uint32(data[LengthOffset:]),
+		Time:      t,
+	}
+}
+
+// collect returns the reply of f and adds its timings to the exchange span
+func (sess *Session) collect(f *future) ([]byte, error) {
+	reply, err := f.result()
+	if f.req == nil {
+		return reply, err
+	}
+	if sent := atomic.LoadInt64(&f.req.sent); sent != 0 {
+		sentAt := time.Unix(0, sent)
+		sess.span.queued += sentAt.Sub(f.req.queued)
+		if !f.received.IsZero() {
+			sess.span.server += f.received.Sub(sentAt)
+			sess.span.received = f.received
+		}
+	}
+	return reply, err
+}
+
+// traceComplete hands the finished exchange to the tracer
+func (sess *Session) traceComplete(typ uint8, start time.Time, result string, err error) {
+	if sess.pool == nil || sess.pool.config.Tracer == nil {
+		return
+	}
+	now := time.Now()
+	ev := ExchangeEvent{
+		Server:     sess.pool.server,
+		Type:       typ,
+		Start:      start,
+		Duration:   now.Sub(start),
+		Dial:       sess.span.dial,
+		Queued:     sess.span.queued,
+		ServerTime: sess.span.server,
+		Result:     result,
+		Err:        err,
+	}
+	if !sess.span.received.IsZero() {
+		ev.Decode = now.Sub(sess.span.received)
+	}
+	sess.Lock()
+	ev.SessionID = sess.SessionID
+	sess.Unlock()
+	sess.pool.config.Tracer.OnComplete(ev)
+}
+
+// JSONTracer writes every event as a span in a JSON object of its own line
+type JSONTracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONTracer returns a tracer logging spans to w
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{enc: json.NewEncoder(w)}
+}
+
+// jsonSpan is the line written for each event, durations in microseconds
+type jsonSpan struct {
+	Span       string    `json:"span"`
+	Server     string    `json:"server"`
+	Local      string    `json:"local,omitempty"`
+	SessionID  uint32    `json:"session_id,omitempty"`
+	Type       string    `json:"type,omitempty"`
+	SeqNo      uint8     `json:"seq_no,omitempty"`
+	Length     uint32    `json:"length,omitempty"`
+	Start      time.Time `json:"start"`
+	Duration   int64     `json:"duration_us"`
+	Dial       int64     `json:"dial_us,omitempty"`
+	Queued     int64     `json:"queued_us,omitempty"`
+	ServerTime int64     `json:"server_us,omitempty"`
+	Decode     int64     `json:"decode_us,omitempty"`
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (j *JSONTracer) write(span *jsonSpan) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(span)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func (j *JSONTracer) OnConnect(ev ConnectEvent) {
+	j.write(&jsonSpan{
+		Span:     "connect",
+		Server:   ev.Server,
+		Local:    ev.Local,
+		Start:    ev.Start,
+		Duration: ev.Duration.Microseconds(),
+		Error:    errString(ev.Err),
+	})
+}
+
+func (j *JSONTracer) OnSend(ev PacketEvent) {
+	j.write(j.packetSpan("send", ev))
+}
+
+func (j *JSONTracer) OnReceive(ev PacketEvent) {
+	j.write(j.packetSpan("receive", ev))
+}
+
+func (j *JSONTracer) packetSpan(span string, ev PacketEvent) *jsonSpan {
+	return &jsonSpan{
+		Span:      span,
+		Server:    ev.Server,
+		SessionID: ev.SessionID,
+		Type:      typeName(ev.Type),
+		SeqNo:     ev.SeqNo,
+		Length:    ev.Length,
+		Start:     ev.Time,
+		Queued:    ev.Queued.Microseconds(),
+	}
+}
+
+func (j *JSONTracer) OnComplete(ev ExchangeEvent) {
+	j.write(&jsonSpan{
+		Span:       "exchange",
+		Server:     ev.Server,
+		SessionID:  ev.SessionID,
+		Type:       typeName(ev.Type),
+		Start:      ev.Start,
+		Duration:   ev.Duration.Microseconds(),
+		Dial:       ev.Dial.Microseconds(),
+		Queued:     ev.Queued.Microseconds(),
+		ServerTime: ev.ServerTime.Microseconds(),
+		Decode:     ev.Decode.Microseconds(),
+		Result:     ev.Result,
+		Error:      errString(ev.Err),
+	})
+}
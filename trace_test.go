@@ -0,0 +1,124 @@
+// trace_test
+package tacacs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordTracer keeps every event it is told about
+type recordTracer struct {
+	sync.Mutex
+	connects  []ConnectEvent
+	sent      []PacketEvent
+	received  []PacketEvent
+	exchanges []ExchangeEvent
+}
+
+func (r *recordTracer) OnConnect(ev ConnectEvent) {
+	r.Lock()
+	r.connects = append(r.connects, ev)
+	r.Unlock()
+}
+
+func (r *recordTracer) OnSend(ev PacketEvent) {
+	r.Lock()
+	r.sent = append(r.sent, ev)
+	r.Unlock()
+}
+
+func (r *recordTracer) OnReceive(ev PacketEvent) {
+	r.Lock()
+	r.received = append(r.received, ev)
+	r.Unlock()
+}
+
+func (r *recordTracer) OnComplete(ev ExchangeEvent) {
+	r.Lock()
+	r.exchanges = append(r.exchanges, ev)
+	r.Unlock()
+}
+
+func TestTracer(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		time.Sleep(20 * time.Millisecond)
+		if hdr.SeqNo == 1 {
+			c.reply(hdr, authenReplyBody(AuthenStatusGetPass, "Password: ", ""))
+		} else {
+			c.reply(hdr, authenReplyBody(AuthenStatusPass, "", ""))
+		}
+	})
+	fakeInit(t, s)
+	rec := &recordTracer{}
+	config := s.config()
+	config.Tracer = rec
+	TacacsConfigSet(config)
+
+	if _, err := AuthenASCII(5, "alice", "secret"); err != nil {
+		t.Fatalf("authen fail:%s", err.Error())
+	}
+
+	rec.Lock()
+	defer rec.Unlock()
+	server := config.ServerIP
+	if len(rec.connects) != 1 || rec.connects[0].Err != nil || rec.connects[0].Local == "" || !strings.HasPrefix(rec.connects[0].Server, server) {
+		t.Fatalf("connects %+v", rec.connects)
+	}
+	if len(rec.sent) != 2 || len(rec.received) != 2 {
+		t.Fatalf("%d packets sent, %d received", len(rec.sent), len(rec.received))
+	}
+	for i, seqNo := range []uint8{1, 3} {
+		if ev := rec.sent[i]; ev.SeqNo != seqNo || ev.Type != TypeAuthen || ev.Length == 0 || ev.Queued < 0 {
+			t.Errorf("sent %+v", ev)
+		}
+		if ev := rec.received[i]; ev.SeqNo != seqNo+1 || ev.SessionID != rec.sent[i].SessionID {
+			t.Errorf("received %+v", ev)
+		}
+	}
+
+	if len(rec.exchanges) != 1 {
+		t.Fatalf("%d exchanges", len(rec.exchanges))
+	}
+	ev := rec.exchanges[0]
+	if ev.Type != TypeAuthen || ev.Result != "pass" || ev.Err != nil || ev.SessionID != rec.sent[0].SessionID {
+		t.Errorf("exchange %+v", ev)
+	}
+	if ev.ServerTime < 40*time.Millisecond || ev.Dial <= 0 || ev.Duration < ev.ServerTime {
+		t.Errorf("exchange timings %+v", ev)
+	}
+}
+
+func TestJSONTracer(t *testing.T) {
+	var buf bytes.Buffer
+	j := NewJSONTracer(&buf)
+	start := time.Now()
+	j.OnConnect(ConnectEvent{Server: "127.0.0.1:49", Local: "127.0.0.1:5000", Start: start, Duration: time.Millisecond})
+	j.OnSend(PacketEvent{Server: "127.0.0.1:49", SessionID: 7, Type: TypeAuthor, SeqNo: 1, Length: 30, Time: start, Queued: 2 * time.Millisecond})
+	j.OnComplete(ExchangeEvent{Server: "127.0.0.1:49", SessionID: 7, Type: TypeAuthor, Start: start, Duration: 5 * time.Millisecond, Result: "timeout", Err: ErrTimeout})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("%d spans:%s", len(lines), buf.String())
+	}
+	var spans []map[string]interface{}
+	for _, line := range lines {
+		var span map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &span); err != nil {
+			t.Fatalf("bad span %q:%s", line, err.Error())
+		}
+		spans = append(spans, span)
+	}
+	if spans[0]["span"] != "connect" || spans[0]["duration_us"] != float64(1000) {
+		t.Errorf("connect span %v", spans[0])
+	}
+	if spans[1]["span"] != "send" || spans[1]["type"] != "author" || spans[1]["queued_us"] != float64(2000) {
+		t.Errorf("send span %v", spans[1])
+	}
+	if spans[2]["span"] != "exchange" || spans[2]["result"] != "timeout" || spans[2]["error"] != "timeout" {
+		t.Errorf("exchange span %v", spans[2])
+	}
+}
@@ -4,17 +4,101 @@ package tacacs
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// recently closed session IDs kept per transport, used to tell a late reply
+// from a reply for a session that never existed on this connection
+const closedSessionHistory = 64
+
+type TransportStats struct {
+	UnknownSession uint64 //replies whose session ID was never seen on this connection
+	LateReply      uint64 //replies for sessions that have already been closed
+	Queued         uint64 //packets waiting for the write loop
+}
+
+// TransportError is handed to every session in flight on a connection that
+// failed or was closed under it
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return "transport error, " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// future is the reply to a request, completed exactly once by the owner
+// goroutine of the transport
+type future struct {
+	done     chan struct{}
+	reply    []byte
+	err      error
+	req      *request  //the request the reply answers
+	received time.Time //when the reply was read
+}
+
+func newFuture() *future {
+	return &future{done: make(chan struct{})}
+}
+
+// complete must only be called by the owner goroutine
+func (f *future) complete(reply []byte, err error) {
+	f.reply, f.err = reply, err
+	close(f.done)
+}
+
+// result returns the reply once done is closed
+func (f *future) result() ([]byte, error) {
+	<-f.done
+	return f.reply, f.err
+}
+
+// request is a packet queued for the write loop
+type request struct {
+	data   []byte
+	queued time.Time
+	sent   int64 //unix nano the write loop wrote it at, 0 until then
+}
+
+// Transport is one connection to a server. Its state is owned by the run
+// goroutine, everything else hands it closures through ops. The read and
+// write loops only do the blocking I/O and never touch the state.
 type Transport struct {
-	netConn *conn
-	sendChn chan []byte
-	Done    bool
-	wg      sync.WaitGroup
-	sync.RWMutex
+	netConn  *conn
+	ops      chan func()
+	recvChn  chan []byte
+	writeChn chan *request
+	wg       sync.WaitGroup
+
+	err      error         //why the transport failed, set before failChn is closed
+	failChn  chan struct{} //closed when the connection is gone
+	failOnce sync.Once
+	closing  int32 //closed on purpose, not by a connection failure
+
+	//owned by run
+	sessions   map[uint32]struct{} //sessions running on this connection
+	futures    map[uint32]*future  //the reply each session waits for
+	queue      []*request          //packets waiting for the write loop
+	closedIDs  map[uint32]struct{}
+	closedRing []uint32
+	stopping   bool //no new sessions, the transport is about to close
+
+	server     string
+	tracer     Tracer
+	stats      TransportStats
+	sessionCnt int32
+	lastActive int64 //unix nano of the last packet sent or received
 }
 
 func newTransport(ctx context.Context, config TacacsConfig) (*Transport, error) {
@@ -27,8 +111,18 @@ func newTransport(ctx context.Context, config TacacsConfig) (*Transport, error)
 		fmt.Println("create conn success")
 	}
 
-	t.sendChn = make(chan []byte, 100)
-	t.wg.Add(2)
+	t.lastActive = time.Now().UnixNano()
+	t.server = net.JoinHostPort(config.ServerIP, strconv.FormatUint(uint64(config.ServerPort), 10))
+	t.tracer = config.Tracer
+	t.ops = make(chan func())
+	t.recvChn = make(chan []byte)
+	t.writeChn = make(chan *request)
+	t.failChn = make(chan struct{})
+	t.sessions = make(map[uint32]struct{})
+	t.futures = make(map[uint32]*future)
+	t.closedIDs = make(map[uint32]struct{})
+	t.wg.Add(3)
+	go t.run()
 	go t.readLoop()
 	go t.writeLoop()
 
@@ -37,85 +131,228 @@ func newTransport(ctx context.Context, config TacacsConfig) (*Transport, error)
 }
 
 func (t *Transport) close() {
-	t.netConn.Lock()
-	if t.netConn.nc != nil {
-		fmt.Println("close conn")
-		t.netConn.nc.Close()
-	}
-	t.netConn.Unlock()
-	t.Lock()
-	t.Done = true
-	close(t.sendChn)
-	t.Unlock()
+	atomic.StoreInt32(&t.closing, 1)
+	t.fail(errors.New("transport closed"))
 	t.wg.Wait()
 	fmt.Println("transport close success")
 }
 
-func (t *Transport) writeLoop() {
+// fail marks the transport as broken and shuts the connection, the owner
+// then hands err to every session still waiting for a reply
+func (t *Transport) fail(err error) {
+	t.failOnce.Do(func() {
+		t.err = err
+		close(t.failChn)
+		fmt.Println("close conn")
+		t.netConn.nc.Close()
+		fmt.Printf("transport fail, %s\n", err.Error())
+	})
+}
+
+// run owns the state of the transport until the connection fails
+func (t *Transport) run() {
 	defer t.wg.Done()
 	for {
+		var writeChn chan *request
+		var next *request
+		if len(t.queue) > 0 {
+			writeChn, next = t.writeChn, t.queue[0]
+		}
+		atomic.StoreUint64(&t.stats.Queued, uint64(len(t.queue)))
+
 		select {
-		case data, ok := <-t.sendChn:
-			if !ok {
-				fmt.Println("transport send channel closed")
-				return
+		case fn := <-t.ops:
+			fn()
+		case writeChn <- next:
+			t.queue[0] = nil
+			t.queue = t.queue[1:]
+		case data := <-t.recvChn:
+			t.dispatch(data)
+		case <-t.failChn:
+			terr := &TransportError{Err: t.err}
+			for sessionID, f := range t.futures {
+				f.complete(nil, terr)
+				delete(t.futures, sessionID)
 			}
+			t.queue = nil
+			return
+		}
+	}
+}
 
-			dataLen := len(data)
-			//fmt.Printf("data to be send:%d\n", dataLen)
-			sendLen := 0
-			for {
-				num, err := t.netConn.nc.Write(data[sendLen:])
-				if err != nil {
-					fmt.Printf("conn write error:%s", err.Error())
-					return
-				}
-
-				sendLen += num
-				if dataLen == sendLen {
-					//fmt.Println("conn write success")
-					break
-				}
-			}
+// do runs fn on the owner goroutine, false when the transport is gone
+func (t *Transport) do(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case t.ops <- func() { fn(); close(done) }:
+		<-done
+		return true
+	case <-t.failChn:
+		return false
+	}
+}
+
+// alive reports whether the transport can still carry new sessions
+func (t *Transport) alive() bool {
+	select {
+	case <-t.failChn:
+		return false
+	default:
+		return atomic.LoadInt32(&t.closing) == 0
+	}
+}
+
+// isClosing reports whether the transport was closed on purpose
+func (t *Transport) isClosing() bool {
+	return atomic.LoadInt32(&t.closing) != 0
+}
+
+// request queues data for the write loop and returns the future of the reply,
+// a session has at most one request waiting for a reply
+func (t *Transport) request(sessionID uint32, data []byte) (*future, error) {
+	f := newFuture()
+	f.req = &request{data: data, queued: time.Now()}
+	ok := t.do(func() {
+		if old := t.futures[sessionID]; old != nil {
+			old.complete(nil, errors.New("superseded by a new request"))
 		}
+		t.futures[sessionID] = f
+		t.queue = append(t.queue, f.req)
+		t.touch()
+	})
+	if !ok {
+		return nil, errors.New("transport exit, send packet fail")
 	}
+	return f, nil
 }
 
-//read 读取指定长度字符
-func (t *Transport) readPacketHdr() ([]byte, error) {
-	data := make([]byte, HeaderLen, 1024)
+// addSession registers a session on the transport, limit caps the sessions in
+// flight on the connection, zero means no cap
+func (t *Transport) addSession(sessionID uint32, limit int32) error {
+	var err error
+	ok := t.do(func() {
+		if t.stopping {
+			err = errors.New("transport exit, add session fail")
+			return
+		}
+		if limit > 0 && int32(len(t.sessions)) >= limit {
+			err = errors.New("transport full, add session fail")
+			return
+		}
+		t.sessions[sessionID] = struct{}{}
+		atomic.StoreInt32(&t.sessionCnt, int32(len(t.sessions)))
+	})
+	if !ok {
+		return errors.New("transport exit, add session fail")
+	}
+	return err
+}
 
-	readLen := 0
+func (t *Transport) removeSession(sessionID uint32) {
+	t.do(func() {
+		if _, ok := t.sessions[sessionID]; !ok {
+			return
+		}
+		delete(t.sessions, sessionID)
+		atomic.StoreInt32(&t.sessionCnt, int32(len(t.sessions)))
+		if f := t.futures[sessionID]; f != nil {
+			f.complete(nil, errors.New("session closed"))
+			delete(t.futures, sessionID)
+		}
+		t.touch()
 
-	for {
-		num, err := t.netConn.nc.Read(data[readLen:])
-		if err != nil {
-			fmt.Println(err.Error())
-			return nil, err
+		if len(t.closedRing) == closedSessionHistory {
+			delete(t.closedIDs, t.closedRing[0])
+			t.closedRing = t.closedRing[1:]
 		}
+		t.closedRing = append(t.closedRing, sessionID)
+		t.closedIDs[sessionID] = struct{}{}
+	})
+}
+
+func (t *Transport) touch() {
+	atomic.StoreInt64(&t.lastActive, time.Now().UnixNano())
+}
 
-		readLen += num
-		if readLen == HeaderLen {
-			return data, nil
+// closeIfIdle closes the transport when no session used it for idle, the
+// check is atomic against addSession
+func (t *Transport) closeIfIdle(idle time.Duration) bool {
+	var last time.Time
+	idleClose := false
+	t.do(func() {
+		last = time.Unix(0, atomic.LoadInt64(&t.lastActive))
+		if len(t.sessions) != 0 || time.Since(last) < idle {
+			return
 		}
+		t.stopping = true
+		atomic.StoreInt32(&t.closing, 1)
+		idleClose = true
+	})
+	if !idleClose {
+		//gone already when do failed
+		return !t.alive()
 	}
+
+	fmt.Printf("connection idle for %s, close\n", time.Since(last))
+	t.close()
+	return true
 }
 
-func (t *Transport) readLoop() {
+// Stats returns the reply demultiplexing counters and the send queue depth of
+// the transport
+func (t *Transport) Stats() TransportStats {
+	return TransportStats{
+		UnknownSession: atomic.LoadUint64(&t.stats.UnknownSession),
+		LateReply:      atomic.LoadUint64(&t.stats.LateReply),
+		Queued:         atomic.LoadUint64(&t.stats.Queued),
+	}
+}
+
+func (t *Transport) writeLoop() {
 	defer t.wg.Done()
 	for {
-		t.netConn.RLock()
-		if t.netConn.nc == nil {
-			fmt.Printf("t.netConn.nc is nil, return")
-			t.netConn.RUnlock()
+		select {
+		case <-t.failChn:
 			return
+		case req := <-t.writeChn:
+			//Write only returns early with an error
+			if _, err := t.netConn.nc.Write(req.data); err != nil {
+				fmt.Printf("conn write error:%s\n", err.Error())
+				t.fail(err)
+				return
+			}
+			now := time.Now()
+			atomic.StoreInt64(&req.sent, now.UnixNano())
+			if t.tracer != nil {
+				ev := packetEvent(t.server, req.data, now)
+				ev.Queued = now.Sub(req.queued)
+				t.tracer.OnSend(ev)
+			}
+			//an unencrypted packet may carry a password in clear
+			wipe(req.data)
 		}
-		t.netConn.RUnlock()
+	}
+}
+
+//read 读取指定长度字符
+func (t *Transport) readPacketHdr() ([]byte, error) {
+	data := make([]byte, HeaderLen)
 
+	if _, err := io.ReadFull(t.netConn.nc, data); err != nil {
+		fmt.Println(err.Error())
+		return nil, err
+	}
+	return data, nil
+}
+
+func (t *Transport) readLoop() {
+	defer t.wg.Done()
+	for {
 		h, err := t.readPacketHdr()
 		if err != nil {
 
 			fmt.Printf("read packet header fail:%s\n", err.Error())
+			t.fail(err)
 			return
 		} else {
 			tacacsType := uint8(h[TypeOffset])
@@ -124,50 +361,72 @@ func (t *Transport) readLoop() {
 			case TypeAuthor:
 			case TypeAuthen:
 			default:
-				fmt.Println("error, invalid tacacs version")
-				continue
+				//the body can't be trusted to be framed like ours, resynchronising
+				//on the next header would read it from inside the body
+				err := &ProtocolError{Reason: fmt.Sprintf("packet of unknown type %d", tacacsType)}
+				fmt.Printf("%s\n", err.Error())
+				t.fail(err)
+				return
 			}
 		}
 
-		recv, err := t.readPacketBody(h)
+		recv, err := readPacketBody(t.netConn.nc, h)
 		if err != nil {
 			if err == io.EOF {
 				fmt.Println("read Eof, close")
-				return
+			} else {
+				fmt.Printf("read packet body fail:%s\n", err.Error())
 			}
-
-			fmt.Println("read packet header fail:%s", err.Error())
-			continue
+			//the stream can't be resynchronised once a body is lost
+			t.fail(err)
+			return
 		}
 
 		//fmt.Println("conn read success,dataLen:", len(recv))
-		dispatch(recv)
+		t.touch()
+		if t.tracer != nil {
+			t.tracer.OnReceive(packetEvent(t.server, recv, time.Now()))
+		}
+		select {
+		case t.recvChn <- recv:
+		case <-t.failChn:
+			return
+		}
 	}
 }
 
-func dispatch(data []byte) {
+// dispatch completes the future of the session a reply belongs to, it runs on
+// the owner goroutine and never blocks
+func (t *Transport) dispatch(data []byte) {
 
 	sessionID := binary.BigEndian.Uint32(data[SessionIDOffset:])
 
-	value, ok := TacacsMng.Sessions.Load(sessionID)
-	if ok {
-		sess, ok := value.(*Session)
-		if ok {
-			fmt.Printf("found session, dispatch success\n")
-			sess.Lock()
-			sess.ReadBuffer <- data
-			sess.Unlock()
-
-		} else {
-			fmt.Printf("*** error, interface assert fail ***\n")
-		}
+	if f := t.futures[sessionID]; f != nil {
+		delete(t.futures, sessionID)
+		f.received = time.Now()
+		f.complete(data, nil)
+		return
+	}
 
+	//a reply nobody waits for on a live session came after its request was
+	//abandoned, so it is as late as one for a closed session
+	_, open := t.sessions[sessionID]
+	_, closed := t.closedIDs[sessionID]
+	if open || closed {
+		n := atomic.AddUint64(&t.stats.LateReply, 1)
+		fmt.Printf("drop late reply for session %d, late replies:%d\n", sessionID, n)
 	} else {
-		fmt.Println("error, no invalid session found")
+		n := atomic.AddUint64(&t.stats.UnknownSession, 1)
+		fmt.Printf("drop reply for unknown session %d, unknown replies:%d\n", sessionID, n)
 	}
 }
 
-func (t *Transport) readPacketBody(data []byte) ([]byte, error) {
+// readPacketBody reads the body announced by the header data from r and
+// returns header and body in one slice
+func readPacketBody(r io.Reader, data []byte) ([]byte, error) {
+	if len(data) != HeaderLen {
+		return nil, fmt.Errorf("invalid header size %d", len(data))
+	}
 
 	bodyLen := binary.BigEndian.Uint32(data[LengthOffset:])
 	if bodyLen > MaxPacketLen {
@@ -176,20 +435,12 @@ func (t *Transport) readPacketBody(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("empty packet body")
 	}
 
-	p := append(data, make([]byte, bodyLen)...)
+	p := make([]byte, HeaderLen+int(bodyLen))
+	copy(p, data)
 
-	startLen := len(data)
-	totalLen := len(p)
-	for {
-		num, err := t.netConn.nc.Read(p[startLen:])
-		if err != nil {
-			fmt.Println(err.Error())
-			return nil, err
-		}
-
-		startLen += num
-		if startLen == totalLen {
-			return p, nil
-		}
+	if _, err := io.ReadFull(r, p[HeaderLen:]); err != nil {
+		fmt.Println(err.Error())
+		return nil, err
 	}
+	return p, nil
 }
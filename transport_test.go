@@ -0,0 +1,541 @@
+// transport_test
+package tacacs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeKey = "12345678"
+
+// fakeServer is a loopback TACACS+ server, every request is decrypted and
+// handed to handle which decides what (if anything) to send back
+type fakeServer struct {
+	ln     net.Listener
+	key    string
+	flags  uint8
+	handle func(c *fakeConn, hdr TacacsHeader, body []byte)
+
+	sync.Mutex
+	conns []*fakeConn
+	wg    sync.WaitGroup
+}
+
+type fakeConn struct {
+	net.Conn
+	srv *fakeServer
+	sync.Mutex
+}
+
+func newFakeServer(t *testing.T, handle func(c *fakeConn, hdr TacacsHeader, body []byte)) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen fail:%s", err.Error())
+	}
+	return serveFake(ln, handle)
+}
+
+func serveFake(ln net.Listener, handle func(c *fakeConn, hdr TacacsHeader, body []byte)) *fakeServer {
+
+	s := &fakeServer{ln: ln, key: fakeKey, handle: handle}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		s.accept(nc)
+	}
+}
+
+// accept serves requests arriving on nc
+func (s *fakeServer) accept(nc net.Conn) {
+	c := &fakeConn{Conn: nc, srv: s}
+	s.Lock()
+	s.conns = append(s.conns, c)
+	s.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		c.serve()
+	}()
+}
+
+func (c *fakeConn) serve() {
+	defer c.Close()
+	for {
+		p := make([]byte, HeaderLen)
+		if _, err := io.ReadFull(c, p); err != nil {
+			return
+		}
+
+		hdr := TacacsHeader{}
+		hdr.unmarshal(p)
+		p = append(p, make([]byte, hdr.Length)...)
+		if _, err := io.ReadFull(c, p[HeaderLen:]); err != nil {
+			return
+		}
+
+		if hdr.Flags&UnencryptedFlag == 0 {
+			crypt(p, []byte(c.srv.key))
+		}
+		c.srv.handle(c, hdr, p[HeaderLen:])
+	}
+}
+
+// reply answers req with body, the header is derived from the request
+func (c *fakeConn) reply(req TacacsHeader, body []byte) {
+	hdr := req
+	hdr.SeqNo++
+	hdr.Flags = c.srv.flags
+	c.write(hdr, body)
+}
+
+func (c *fakeConn) write(hdr TacacsHeader, body []byte) {
+	hdr.Length = uint32(len(body))
+	p := append(hdr.marshal(), body...)
+	if hdr.Flags&UnencryptedFlag == 0 {
+		crypt(p, []byte(c.srv.key))
+	}
+
+	c.Lock()
+	c.Write(p)
+	c.Unlock()
+}
+
+func (s *fakeServer) port() uint16 {
+	return uint16(s.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *fakeServer) config() TacacsConfig {
+	var config TacacsConfig
+	config.IPtype = "ip4"
+	config.ServerIP = s.ln.Addr().(*net.TCPAddr).IP.String()
+	if s.ln.Addr().(*net.TCPAddr).IP.To4() == nil {
+		config.IPtype = "ip6"
+	}
+	config.ServerPort = s.port()
+	config.ShareKey = Secret(s.key)
+	config.ConnMultiplexing = s.flags&SingleConnectFlag != 0
+	return config
+}
+
+func (s *fakeServer) close() {
+	s.ln.Close()
+	s.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.Unlock()
+	s.wg.Wait()
+}
+
+// fakeInit points the package at the fake server and undoes it when the test ends
+func fakeInit(t *testing.T, s *fakeServer) {
+	TacacsInit()
+	TacacsConfigSet(s.config())
+
+	t.Cleanup(func() {
+		checkLeaks(t)
+		TacacsExit()
+		s.close()
+	})
+}
+
+// checkLeaks fails the test when a session is still open or holds a pool slot,
+// sessions closed in the background get a moment to finish
+func checkLeaks(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		inFlight := 0
+		for _, stats := range TacacsPoolStats() {
+			inFlight += stats.InFlight
+		}
+		open := TacacsMng.OpenSessions()
+		if open == 0 && inFlight == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("leaked %d open sessions and %d pool slots", open, inFlight)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// fakeSingleConnect lets sessions share connections before any server reply
+func fakeSingleConnect() {
+	TacacsMng.Lock()
+	p := TacacsMng.pool()
+	TacacsMng.Unlock()
+	p.setSingleConnect()
+}
+
+func authenReplyBody(status uint8, msg, data string) []byte {
+	body := make([]byte, 6)
+	body[0] = status
+	binary.BigEndian.PutUint16(body[2:], uint16(len(msg)))
+	binary.BigEndian.PutUint16(body[4:], uint16(len(data)))
+	body = append(body, msg...)
+	return append(body, data...)
+}
+
+func authorReplyBody(status uint8, msg string, args ...string) []byte {
+	body := make([]byte, 6)
+	body[0] = status
+	body[1] = uint8(len(args))
+	binary.BigEndian.PutUint16(body[2:], uint16(len(msg)))
+	for _, arg := range args {
+		body = append(body, uint8(len(arg)))
+	}
+	body = append(body, msg...)
+	for _, arg := range args {
+		body = append(body, arg...)
+	}
+	return body
+}
+
+func acctReplyBody(status uint8, msg string) []byte {
+	body := make([]byte, 5)
+	binary.BigEndian.PutUint16(body, uint16(len(msg)))
+	body[4] = status
+	return append(body, msg...)
+}
+
+// authorUser returns the user field of an authorization request body
+func authorUser(body []byte) string {
+	return string(body[8+int(body[7]) : 8+int(body[7])+int(body[4])])
+}
+
+// authorRemAddr returns the rem_addr field of an authorization request body
+func authorRemAddr(body []byte) string {
+	offset := 8 + int(body[7]) + int(body[4]) + int(body[5])
+	return string(body[offset : offset+int(body[6])])
+}
+
+func TestTransportDemux(t *testing.T) {
+	var mu sync.Mutex
+	var pending []func()
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		status := AuthorStatusPassAdd
+		if authorUser(body) == "bob" {
+			status = AuthorStatusFail
+		}
+
+		//hold the first request back so the replies go out in reverse order
+		mu.Lock()
+		pending = append(pending, func() { c.reply(hdr, authorReplyBody(status, "")) })
+		if len(pending) == 2 {
+			pending[1]()
+			pending[0]()
+		}
+		mu.Unlock()
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+	fakeSingleConnect()
+
+	alice, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer alice.Close()
+	bob, err := NewSession(TacacsMng.ctx, 5, "bob", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer bob.Close()
+	if alice.t != bob.t {
+		t.Fatalf("sessions are not multiplexed on one transport")
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := Author(alice, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, bobErr := Author(bob, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if bobErr == nil {
+		t.Errorf("bob got alice's reply")
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("alice got bob's reply:%s", err.Error())
+	}
+
+	if stats := alice.t.Stats(); stats.UnknownSession != 0 || stats.LateReply != 0 {
+		t.Errorf("unexpected stray replies:%+v", stats)
+	}
+}
+
+func TestTransportStrayReplies(t *testing.T) {
+	var firstHdr TacacsHeader
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		if firstHdr.SessionID == 0 {
+			firstHdr = hdr
+		} else {
+			//a duplicate reply for the finished session, then one nobody asked for
+			c.reply(firstHdr, authorReplyBody(AuthorStatusPassAdd, ""))
+			unknown := hdr
+			unknown.SessionID ^= 0xffffffff
+			c.reply(unknown, authorReplyBody(AuthorStatusPassAdd, ""))
+		}
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+	fakeSingleConnect()
+
+	first, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer first.Close()
+	_, err = Author(first, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author fail:%s", err.Error())
+	}
+
+	second, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer second.Close()
+	first.Close()
+	_, err = Author(second, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author fail:%s", err.Error())
+	}
+	second.Close()
+
+	stats := first.t.Stats()
+	if stats.LateReply != 1 || stats.UnknownSession != 1 {
+		t.Errorf("stray replies not counted:%+v", stats)
+	}
+}
+
+func TestTransportUnknownType(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		//a packet of no known type with a body, then the real reply
+		stray := hdr
+		stray.SeqNo++
+		stray.Type = 9
+		c.write(stray, authorReplyBody(AuthorStatusPassAdd, "stray"))
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	fakeInit(t, s)
+
+	sess, err := NewSession(TacacsMng.ctx, 30, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+
+	start := time.Now()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	var perr *ProtocolError
+	if !errors.As(err, &perr) {
+		t.Fatalf("unknown packet type accepted:%v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("session waited for the timeout instead of failing")
+	}
+	if sess.t.alive() {
+		t.Errorf("connection not reset after an unknown packet type")
+	}
+}
+
+func TestTransportDropFailsSessions(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.Close()
+	})
+	fakeInit(t, s)
+
+	sess, err := NewSession(TacacsMng.ctx, 30, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer sess.Close()
+
+	start := time.Now()
+	_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err == nil {
+		t.Fatalf("author succeeded on a dropped connection")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("session waited for the timeout instead of failing")
+	}
+}
+
+func TestTransportConcurrent(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+
+	config := s.config()
+	config.PoolMaxConns = 4
+	config.MaxInFlight = 8
+	TacacsConfigSet(config)
+	fakeSingleConnect()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				sess, err := NewSession(TacacsMng.ctx, 10, "alice", "")
+				if err != nil {
+					errs <- err
+					return
+				}
+				_, err = Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+				sess.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent author fail:%s", err.Error())
+	}
+	if n := TacacsPoolStats()[0].InFlight; n != 0 {
+		t.Errorf("%d sessions still in flight", n)
+	}
+}
+
+func TestTransportCloseUnderLoad(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+	fakeSingleConnect()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sess, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+				if err != nil {
+					continue
+				}
+				Author(sess, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+				sess.Close()
+			}
+		}()
+	}
+
+	//tear the pools down under the senders, they fail but never hang
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		TacacsConfigSet(s.config())
+		fakeSingleConnect()
+	}
+	close(stop)
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("sessions hang after their transport was closed")
+	}
+}
+
+func TestTransportAbandonedReplies(t *testing.T) {
+	s := newFakeServer(t, func(c *fakeConn, hdr TacacsHeader, body []byte) {
+		n := 1
+		if authorUser(body) == "alice" {
+			//far more replies than anyone waits for
+			n = 50
+		}
+		for i := 0; i < n; i++ {
+			c.reply(hdr, authorReplyBody(AuthorStatusPassAdd, ""))
+		}
+	})
+	s.flags = SingleConnectFlag
+	fakeInit(t, s)
+	fakeSingleConnect()
+
+	alice, err := NewSession(TacacsMng.ctx, 5, "alice", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer alice.Close()
+	defer alice.Close()
+	if err := alice.send(AuthorStart(alice, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone)); err != nil {
+		t.Fatalf("send fail:%s", err.Error())
+	}
+
+	//alice never reads her replies, bob must not be stuck behind them
+	bob, err := NewSession(TacacsMng.ctx, 5, "bob", "")
+	if err != nil {
+		t.Fatalf("new session fail:%s", err.Error())
+	}
+	defer bob.Close()
+	if alice.t != bob.t {
+		t.Fatalf("sessions are not multiplexed on one transport")
+	}
+	_, err = Author(bob, AuthenMethodNotSet, PrivLvlRoot, AuthenTypeNotSet, AuthenServiceNone, "service=shell")
+	if err != nil {
+		t.Fatalf("author behind abandoned replies fail:%s", err.Error())
+	}
+	if n := alice.t.Stats().LateReply; n != 49 {
+		t.Errorf("late replies:%d, expect 49", n)
+	}
+}
+
+func FuzzReadPacketBody(f *testing.F) {
+	f.Add(packet(TypeAuthor, authorReplyBody(AuthorStatusPassAdd, "")))
+	f.Add(packet(TypeAcct, nil))
+	f.Add([]byte{0xc0, 1, 2, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < HeaderLen {
+			return
+		}
+
+		hdr := TacacsHeader{}
+		hdr.unmarshal(data)
+		p, err := readPacketBody(bytes.NewReader(data[HeaderLen:]), data[:HeaderLen])
+		if err != nil {
+			return
+		}
+		if len(p) != HeaderLen+int(hdr.Length) || hdr.Length > MaxPacketLen {
+			t.Fatalf("read %d bytes for header length %d", len(p), hdr.Length)
+		}
+	})
+}